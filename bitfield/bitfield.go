@@ -2,14 +2,62 @@ package bitfield
 
 type Bitfield []byte
 
+// an empty bitfield large enough for numPieces pieces
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// a bitfield with all of the numPieces pieces set
+func Full(numPieces int) Bitfield {
+	bf := New(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
 
 func (bf Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+// true when no piece is set
+func (bf Bitfield) Empty() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// true when other has one of the first numPieces pieces that bf doesn't
+func (bf Bitfield) Missing(other Bitfield, numPieces int) bool {
+	for i := 0; i*8 < numPieces && i < len(other); i++ {
+		wanted := other[i]
+		if i < len(bf) {
+			wanted &^= bf[i]
+		}
+		// spare bits past the last piece don't count
+		if rest := numPieces - i*8; rest < 8 {
+			wanted &= 0xff << (8 - rest)
+		}
+		if wanted != 0 {
+			return true
+		}
+	}
+	return false
+}
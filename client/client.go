@@ -3,12 +3,20 @@ package client
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"gotorrent/bitfield"
 	"gotorrent/handshake"
 	"gotorrent/message"
+	"gotorrent/mse"
+	"gotorrent/ratelimit"
 	"gotorrent/torrentfile"
+	"gotorrent/utp"
 	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,9 +27,67 @@ type Client struct {
 	Choking     bool
 	Interesting bool
 	Bitfield    bitfield.Bitfield
+	// pieces the peer lets us request while it chokes us (BEP 6)
+	AllowedFast map[int]bool
 	peer        torrentfile.Peer
 	infohash    [20]byte
 	peerID      [20]byte
+	remoteID    [20]byte
+	reserved    handshake.Reserved
+	outbound    bool
+	pending     *message.Message
+	writeMu     sync.Mutex
+	requestsMu  sync.Mutex
+	// outstanding requests and when they were sent
+	requests map[message.Block]time.Time
+	// the quickest any request was answered
+	minLatency time.Duration
+	extMu      sync.Mutex
+	extensions []registeredExtension
+	peerExt    *message.ExtendedHandshake
+	// payload bytes of the blocks received from and sent to the peer
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// limits of the torrent the peer belongs to, on top of the global ones
+	downLimit *ratelimit.Limiter
+	upLimit   *ratelimit.Limiter
+}
+
+// whether peer connections are encrypted, set once before any connections
+// are made
+var Encryption = mse.Preferred
+
+// the socket outgoing uTP connections are made from, peers are only dialed
+// over TCP when nil
+var UTP *utp.Socket
+
+// bytes per second received from and sent to all peers together, unlimited
+// until their rate is set. Only block data counts towards the upload limit so
+// protocol messages are never held up behind it
+var (
+	DownloadLimit = ratelimit.New(0)
+	UploadLimit   = ratelimit.New(0)
+)
+
+const (
+	// the encryption and BitTorrent handshakes have to finish within this
+	handshakeTimeout = 15 * time.Second
+	// reads are cut into chunks of at most this so a throttled peer doesn't
+	// take a large share of the download limit at once
+	readChunk = 16 << 10
+	// a peer that hasn't answered our uTP SYN by then is tried over TCP
+	utpDialTimeout = 3 * time.Second
+	// a peer that doesn't take a message off the wire within this is gone,
+	// the write fails rather than blocking its caller for good
+	writeTimeout = 30 * time.Second
+)
+
+// the protocol extensions we advertise in our handshake
+func localReserved() handshake.Reserved {
+	var r handshake.Reserved
+	r.Set(handshake.ExtensionProtocol)
+	r.Set(handshake.FastExtension)
+	return r
 }
 
 func handshakeWithPeer(conn net.Conn, peerID [20]byte, infohash [20]byte, peer torrentfile.Peer) (*handshake.HandShake, error) {
@@ -29,6 +95,7 @@ func handshakeWithPeer(conn net.Conn, peerID [20]byte, infohash [20]byte, peer t
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infohash,
 		PeerID:   peerID,
+		Reserved: localReserved(),
 	}
 
 	req := h.Serialize()
@@ -49,75 +116,300 @@ func handshakeWithPeer(conn net.Conn, peerID [20]byte, infohash [20]byte, peer t
 	return res, nil
 }
 
-func recBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+// receives the bitfield from the peer, peers without any pieces may skip it
+// entirely so a different first message is handed back to be processed later
+// and a peer staying silent is treated as having nothing. With the fast
+// extension have all and have none replace the bitfield
+func recBitfield(conn net.Conn, numPieces int, fast bool) (bitfield.Bitfield, *message.Message, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
 	msg, err := message.Read(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %x", msg)
+		return nil, nil, nil
+	}
+
+	switch {
+	case msg.ID == message.MsgBitfield:
+		if len(msg.Payload) != (numPieces+7)/8 {
+			return nil, nil, fmt.Errorf("Bitfield of %d bytes for %d pieces", len(msg.Payload), numPieces)
+		}
+		return msg.Payload, nil, nil
+	case msg.ID == message.MsgHaveAll && fast:
+		return bitfield.Full(numPieces), nil, nil
+	case msg.ID == message.MsgHaveNone && fast:
+		return bitfield.New(numPieces), nil, nil
+	}
+	return nil, msg, nil
+}
+
+// connects and handshakes with a peer without waiting for its bitfield, used
+// when we don't know the torrent's pieces yet such as fetching metadata
+func Connect(peer torrentfile.Peer, peerID, infohash [20]byte) (*Client, error) {
+	conn, err := dial(peer, infohash)
+	if err != nil {
 		return nil, err
 	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	res, err := handshakeWithPeer(conn, peerID, infohash, peer)
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	return msg.Payload, nil
+	return &Client{
+		Conn:        conn,
+		Choked:      true,
+		Interested:  false,
+		Choking:     true,
+		Interesting: false,
+		peer:        peer,
+		infohash:    infohash,
+		peerID:      peerID,
+		remoteID:    res.PeerID,
+		reserved:    res.Reserved,
+		outbound:    true,
+	}, nil
 }
 
-func New(peer torrentfile.Peer, peerID, infohash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port), 10*time.Second)
+// opens a connection to the peer following Encryption, with Preferred a peer
+// that fails the encryption handshake is dialed again in plaintext
+func dial(peer torrentfile.Peer, infohash [20]byte) (net.Conn, error) {
+	addr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
+	conn, err := dialTransport(addr)
+	if err != nil || Encryption == mse.Disabled {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	encrypted, err := mse.Initiate(conn, infohash, Encryption)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if Encryption == mse.Required {
+		return nil, fmt.Errorf("Encryption handshake with %s failed: %v", addr, err)
+	}
+	return dialTransport(addr)
+}
+
+// tries uTP first when there is a socket for it, peers that don't answer
+// over uTP are dialed over TCP
+func dialTransport(addr string) (net.Conn, error) {
+	if UTP != nil {
+		conn, err := UTP.DialTimeout(addr, utpDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout("tcp", addr, 10*time.Second)
+}
+
+// connects to a peer and exchanges bitfields, have is the bitfield of the
+// numPieces pieces of the torrent we can serve
+func New(peer torrentfile.Peer, peerID, infohash [20]byte, have bitfield.Bitfield, numPieces int) (*Client, error) {
+	c, err := Connect(peer, peerID, infohash)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = handshakeWithPeer(conn, peerID, infohash, peer)
+	err = c.exchangeBitfields(have, numPieces)
 	if err != nil {
-		conn.Close()
+		c.Conn.Close()
 		return nil, err
 	}
 
-	// receives the bitfield from the peer
-	bf, err := recBitfield(conn)
+	return c, nil
+}
+
+// completes a connection a peer opened to us, their handshake has already
+// been read to find the torrent it is for so we only reply with ours
+func Accept(conn net.Conn, theirs *handshake.HandShake, peerID [20]byte, have bitfield.Bitfield, numPieces int) (*Client, error) {
+	var peer torrentfile.Peer
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		peer = torrentfile.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		peer = torrentfile.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	default:
+		return nil, fmt.Errorf("Unexpected remote address %s", conn.RemoteAddr())
+	}
+
+	h := handshake.HandShake{
+		Pstr:     "BitTorrent protocol",
+		InfoHash: theirs.InfoHash,
+		PeerID:   peerID,
+		Reserved: localReserved(),
+	}
+
+	_, err := conn.Write(h.Serialize())
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
+	c := &Client{
 		Conn:        conn,
 		Choked:      true,
 		Interested:  false,
 		Choking:     true,
 		Interesting: false,
-		Bitfield:    bf,
 		peer:        peer,
-		infohash:    infohash,
+		infohash:    theirs.InfoHash,
 		peerID:      peerID,
-	}, nil
+		remoteID:    theirs.PeerID,
+		reserved:    theirs.Reserved,
+	}
+
+	err = c.exchangeBitfields(have, numPieces)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
 }
 
-func (c *Client) SendKeepAlive() error {
-	message := message.Message{}
-	_, err := c.Conn.Write(message.Serialize())
+// sends our bitfield and receives the peer's. Without the fast extension an
+// empty bitfield isn't sent at all, with it have all or have none is sent
+// when they describe our pieces
+func (c *Client) exchangeBitfields(have bitfield.Bitfield, numPieces int) error {
+	fast := c.Supports(handshake.FastExtension)
+
+	var err error
+	switch {
+	case fast && have.Empty():
+		err = c.SendHaveNone()
+	case fast && bytes.Equal(have, bitfield.Full(numPieces)):
+		err = c.SendHaveAll()
+	case !have.Empty():
+		err = c.SendBitfield(have)
+	}
+	if err != nil {
+		return err
+	}
+
+	bf, pending, err := recBitfield(c.Conn, numPieces, fast)
 	if err != nil {
 		return err
 	}
+	c.Bitfield = bf
+	c.pending = pending
 	return nil
 }
 
+// the address of the peer, for inbound connections the port is the one the
+// peer connected from rather than the one it listens on
+func (c *Client) Peer() torrentfile.Peer {
+	return c.peer
+}
+
+// the peer id the peer sent in its handshake
+func (c *Client) RemotePeerID() [20]byte {
+	return c.remoteID
+}
+
+// true when we opened the connection, so the peer accepts connections at
+// the address returned by Peer
+func (c *Client) Outbound() bool {
+	return c.outbound
+}
+
+// true when the connection went through the encryption handshake and its
+// payload is RC4 encrypted
+func (c *Client) Encrypted() bool {
+	conn, ok := c.Conn.(*mse.Conn)
+	return ok && conn.Encrypted()
+}
+
+// reads the next message from the peer, nil means keep alive
+func (c *Client) Read() (*message.Message, error) {
+	if c.pending != nil {
+		msg := c.pending
+		c.pending = nil
+		return msg, nil
+	}
+	msg, err := message.Read(limitedReader{c})
+	if err == nil && msg != nil && msg.ID == message.MsgPiece && len(msg.Payload) > 8 {
+		c.downloaded.Add(int64(len(msg.Payload) - 8))
+	}
+	return msg, err
+}
+
+// block bytes received from the peer so far, safe to call from other
+// goroutines
+func (c *Client) Downloaded() int64 {
+	return c.downloaded.Load()
+}
+
+// block bytes sent to the peer so far, safe to call from other goroutines
+func (c *Client) Uploaded() int64 {
+	return c.uploaded.Load()
+}
+
+// writes a message to the peer, safe to call from several goroutines
+func (c *Client) send(msg *message.Message) error {
+	buf := msg.Serialize()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// writes a message without touching Choking or Interested, for callers that
+// keep those in step with the messages themselves
+func (c *Client) Send(msg *message.Message) error {
+	return c.send(msg)
+}
+
+// limits the peer's traffic by the torrent's limiters as well as the global
+// ones, nil leaves a direction limited only globally. Set before the client
+// is shared with other goroutines
+func (c *Client) SetLimits(download, upload *ratelimit.Limiter) {
+	c.downLimit = download
+	c.upLimit = upload
+}
+
+// reads from the peer's connection within the download limits
+type limitedReader struct {
+	c *Client
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	n, err := r.c.Conn.Read(p[:min(len(p), readChunk)])
+	DownloadLimit.Wait(n)
+	r.c.downLimit.Wait(n)
+	return n, err
+}
+
+// true when the peer advertised the protocol extension in its handshake
+func (c *Client) Supports(bit handshake.ReservedBit) bool {
+	return c.reserved.Has(bit)
+}
+
+func (c *Client) SendKeepAlive() error {
+	return c.send(nil)
+}
+
 func (c *Client) SendUnchoke() error {
 	message := message.Message{
 		ID: message.MsgUnchoke,
 	}
-	_, err := c.Conn.Write(message.Serialize())
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
+
+	c.Choking = false
 	return nil
 }
 
@@ -125,10 +417,12 @@ func (c *Client) SendChoke() error {
 	message := message.Message{
 		ID: message.MsgChoke,
 	}
-	_, err := c.Conn.Write(message.Serialize())
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
+
+	c.Choking = true
 	return nil
 }
 
@@ -136,7 +430,7 @@ func (c *Client) SendInterested() error {
 	message := message.Message{
 		ID: message.MsgInterested,
 	}
-	_, err := c.Conn.Write(message.Serialize())
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
@@ -149,42 +443,150 @@ func (c *Client) SendUninterested() error {
 	message := message.Message{
 		ID: message.MsgNotInterested,
 	}
-	_, err := c.Conn.Write(message.Serialize())
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
 
-	c.Interested = true
+	c.Interested = false
 	return nil
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	message := message.Message{
-		ID:      message.MsgRequest,
-		Payload: payload,
+	b := message.Block{Index: index, Begin: begin, Length: length}
+	err := c.send(message.FormatRequest(b))
+	if err != nil {
+		return err
+	}
+
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	if c.requests == nil {
+		c.requests = make(map[message.Block]time.Time)
+	}
+	c.requests[b] = time.Now()
+	return nil
+}
+
+// withdraws a request we sent earlier, safe to call from other goroutines
+func (c *Client) SendCancel(index, begin, length int) error {
+	b := message.Block{Index: index, Begin: begin, Length: length}
+
+	c.requestsMu.Lock()
+	_, ok := c.requests[b]
+	delete(c.requests, b)
+	c.requestsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return c.send(message.FormatCancel(b))
+}
+
+// drops every outstanding request, peers without the fast extension discard
+// our requests when they choke us
+func (c *Client) DropRequests() []message.Block {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+
+	blocks := make([]message.Block, 0, len(c.requests))
+	for b := range c.requests {
+		blocks = append(blocks, b)
 	}
+	c.requests = nil
+	return blocks
+}
+
+// marks a requested block as received or rejected, false if we never asked
+// for it or already canceled it
+func (c *Client) BlockReceived(index, begin, length int) bool {
+	b := message.Block{Index: index, Begin: begin, Length: length}
+
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	sent, ok := c.requests[b]
+	delete(c.requests, b)
+	if ok {
+		latency := time.Since(sent)
+		if c.minLatency == 0 || latency < c.minLatency {
+			c.minLatency = latency
+		}
+	}
+	return ok
+}
+
+// the shortest time the peer took to answer a request, roughly the round
+// trip time of the connection. 0 before the first answer
+func (c *Client) MinLatency() time.Duration {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	return c.minLatency
+}
+
+// the number of requests sent to the peer that haven't been answered
+func (c *Client) PendingRequests() int {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	return len(c.requests)
+}
 
-	_, err := c.Conn.Write(message.Serialize())
+// sends an extension protocol message, id is the message id the peer assigned
+// to the extension in its extended handshake or 0 for the handshake itself
+func (c *Client) SendExtended(id uint8, payload []byte) error {
+	return c.send(message.FormatExtended(id, payload))
+}
+
+func (c *Client) SendHave(index int) error {
+	return c.send(message.FormatIndex(message.MsgHave, index))
+}
+
+func (c *Client) SendHaveAll() error {
+	return c.send(&message.Message{ID: message.MsgHaveAll})
+}
+
+func (c *Client) SendHaveNone() error {
+	return c.send(&message.Message{ID: message.MsgHaveNone})
+}
+
+// tells the peer a request won't be served, only with the fast extension
+func (c *Client) SendReject(index, begin, length int) error {
+	return c.send(message.FormatReject(message.Block{Index: index, Begin: begin, Length: length}))
+}
+
+// lets the peer request the piece even while we choke it
+func (c *Client) SendAllowedFast(index int) error {
+	return c.send(message.FormatIndex(message.MsgAllowedFast, index))
+}
+
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	message := message.Message{
+		ID:      message.MsgBitfield,
+		Payload: bf,
+	}
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Client) SendHave(index int) error {
-	payload := make([]byte, 4)
-	binary.BigEndian.PutUint32(payload[:], uint32(index))
+// sends a block once the upload limits let it through
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	UploadLimit.Wait(len(block))
+	c.upLimit.Wait(len(block))
+
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
 	message := message.Message{
-		ID:      message.MsgHave,
+		ID:      message.MsgPiece,
 		Payload: payload,
 	}
-	_, err := c.Conn.Write(message.Serialize())
+	err := c.send(&message)
 	if err != nil {
 		return err
 	}
+	c.uploaded.Add(int64(len(block)))
 	return nil
 }
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"gotorrent/mse"
+	"gotorrent/ratelimit"
+	"gotorrent/torrentfile"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a peer that only speaks plaintext and hangs up on anything else
+func plaintextPeer(t *testing.T) torrentfile.Peer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				pstr := make([]byte, 20)
+				_, err := io.ReadFull(conn, pstr)
+				if err != nil || string(pstr) != "\x13BitTorrent protocol" {
+					return
+				}
+				conn.Write([]byte("plain"))
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return torrentfile.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDialFallsBackToPlaintext(t *testing.T) {
+	defer func() { Encryption = mse.Preferred }()
+	peer := plaintextPeer(t)
+
+	Encryption = mse.Preferred
+	conn, err := dial(peer, [20]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*mse.Conn); ok {
+		t.Fatal("got an encrypted connection to a plaintext peer")
+	}
+	conn.Write([]byte("\x13BitTorrent protocol"))
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || !bytes.Equal(reply, []byte("plain")) {
+		t.Errorf("read %q, %v after falling back", reply, err)
+	}
+
+	Encryption = mse.Required
+	conn, err = dial(peer, [20]byte{1})
+	if err == nil {
+		conn.Close()
+		t.Error("Required fell back to plaintext")
+	}
+}
+
+func TestOnlyBlocksAreLimited(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go io.Copy(io.Discard, theirs)
+	c := &Client{Conn: ours}
+	c.SetLimits(nil, ratelimit.New(1024))
+
+	// a few hundred bytes of protocol messages would take most of a second
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		err := c.SendUnchoke()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SendHave(i)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("protocol messages waited %v on the upload limit", elapsed)
+	}
+	c.SendPiece(0, 0, make([]byte, 512))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("block went out after %v despite the limit", elapsed)
+	}
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"fmt"
+	"gotorrent/handshake"
+	"gotorrent/message"
+)
+
+// sent as v in our extended handshake
+const Version = "GoTorrent 0.1"
+
+// Extension is a named extension of the extension protocol (BEP 10) such as
+// ut_metadata or ut_pex, registered on every client that should speak it
+type Extension interface {
+	// the peer's extended handshake arrived, the peer supports the extension
+	// when its name is in hs.M. Peers may send the handshake again to update it
+	Handshake(c *Client, hs *message.ExtendedHandshake) error
+	// the peer sent a message to the extension, the payload follows the
+	// extended message id
+	Message(c *Client, payload []byte) error
+}
+
+type registeredExtension struct {
+	name string
+	ext  Extension
+}
+
+// adds an extension to the client, extensions have to be registered before
+// sending the extended handshake so the peer learns about them
+func (c *Client) RegisterExtension(name string, ext Extension) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	c.extensions = append(c.extensions, registeredExtension{name: name, ext: ext})
+}
+
+// sends our extended handshake with the registered extensions filled into m,
+// the peer addresses messages for the i-th registered extension with id i+1
+func (c *Client) SendExtendedHandshake(hs message.ExtendedHandshake) error {
+	if !c.Supports(handshake.ExtensionProtocol) {
+		return fmt.Errorf("Peer %s does not support the extension protocol", c.peer.String())
+	}
+
+	c.extMu.Lock()
+	hs.M = make(map[string]int, len(c.extensions))
+	for i, e := range c.extensions {
+		hs.M[e.name] = i + 1
+	}
+	c.extMu.Unlock()
+
+	if hs.V == "" {
+		hs.V = Version
+	}
+	if hs.YourIP == "" {
+		if ip := c.peer.IP.To4(); ip != nil {
+			hs.YourIP = string(ip)
+		} else {
+			hs.YourIP = string(c.peer.IP.To16())
+		}
+	}
+
+	payload, err := hs.Serialize()
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(0, payload)
+}
+
+// the extended handshake the peer sent, nil until it arrives
+func (c *Client) PeerExtensions() *message.ExtendedHandshake {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.peerExt
+}
+
+// true when the peer's extended handshake lists the extension
+func (c *Client) PeerSupports(name string) bool {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.peerExt != nil && c.peerExt.M[name] != 0
+}
+
+// sends a message to the peer's side of an extension
+func (c *Client) SendExtension(name string, payload []byte) error {
+	c.extMu.Lock()
+	id := 0
+	if c.peerExt != nil {
+		id = c.peerExt.M[name]
+	}
+	c.extMu.Unlock()
+
+	if id <= 0 || id > 255 {
+		return fmt.Errorf("Peer %s does not support %s", c.peer.String(), name)
+	}
+	return c.SendExtended(uint8(id), payload)
+}
+
+// handles an extended message from the peer, the extended handshake is
+// recorded and passed to every extension while other messages go to the
+// extension they are addressed to. Messages for unknown ids are ignored
+func (c *Client) HandleExtended(msg *message.Message) error {
+	id, payload, err := msg.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	c.extMu.Lock()
+	extensions := c.extensions
+	c.extMu.Unlock()
+
+	if id != 0 {
+		if int(id) > len(extensions) {
+			return nil
+		}
+		return extensions[id-1].ext.Message(c, payload)
+	}
+
+	hs, err := message.ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	c.extMu.Lock()
+	c.peerExt = mergeHandshake(c.peerExt, hs)
+	merged := *c.peerExt
+	c.extMu.Unlock()
+
+	for _, e := range extensions {
+		err := e.ext.Handshake(c, &merged)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a repeated extended handshake only carries what changed, ids of 0 remove
+// an extension and fields left out keep their earlier value
+func mergeHandshake(old, hs *message.ExtendedHandshake) *message.ExtendedHandshake {
+	merged := &message.ExtendedHandshake{M: make(map[string]int)}
+	if old != nil {
+		*merged = *old
+		merged.M = make(map[string]int, len(old.M))
+		for name, id := range old.M {
+			merged.M[name] = id
+		}
+	}
+
+	for name, id := range hs.M {
+		if id == 0 {
+			delete(merged.M, name)
+		} else {
+			merged.M[name] = id
+		}
+	}
+	if hs.P != 0 {
+		merged.P = hs.P
+	}
+	if hs.V != "" {
+		merged.V = hs.V
+	}
+	if hs.YourIP != "" {
+		merged.YourIP = hs.YourIP
+	}
+	if hs.Reqq != 0 {
+		merged.Reqq = hs.Reqq
+	}
+	if hs.MetadataSize != 0 {
+		merged.MetadataSize = hs.MetadataSize
+	}
+	return merged
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gotorrent/client"
+	"gotorrent/p2p"
+	"gotorrent/ratelimit"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const controlHelp = `commands, rates in KiB/s and 0 for unlimited:
+  dl <rate>   download limit of all peers
+  ul <rate>   upload limit of all peers
+  tdl <rate>  download limit of the torrent
+  tul <rate>  upload limit of the torrent
+  limits      show the current limits`
+
+// reads commands changing the rate limits while the torrent runs, one per
+// line, until r is closed
+func readCommands(r io.Reader, t *p2p.Torrent) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		reply, err := runCommand(scanner.Text(), t)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if reply != "" {
+			fmt.Println(reply)
+		}
+	}
+}
+
+// runs a single command, returning what to print
+func runCommand(line string, t *p2p.Torrent) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	limiters := map[string]*ratelimit.Limiter{
+		"dl":  client.DownloadLimit,
+		"ul":  client.UploadLimit,
+		"tdl": t.DownloadLimit,
+		"tul": t.UploadLimit,
+	}
+	switch name := fields[0]; {
+	case name == "limits" && len(fields) == 1:
+		return fmt.Sprintf("download %s, upload %s, torrent download %s, torrent upload %s",
+			formatRate(client.DownloadLimit), formatRate(client.UploadLimit),
+			formatRate(t.DownloadLimit), formatRate(t.UploadLimit)), nil
+	case limiters[name] != nil && len(fields) == 2:
+		rate, err := strconv.Atoi(fields[1])
+		if err != nil || rate < 0 {
+			return "", fmt.Errorf("Invalid rate %q, expected KiB/s", fields[1])
+		}
+		limiters[name].SetRate(rate * 1024)
+		return fmt.Sprintf("%s limit set to %s", name, formatRate(limiters[name])), nil
+	case name == "help":
+		return controlHelp, nil
+	}
+	return "", fmt.Errorf("Unknown command %q, type help for the commands", line)
+}
+
+func formatRate(l *ratelimit.Limiter) string {
+	if l.Rate() == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KiB/s", l.Rate()/1024)
+}
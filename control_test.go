@@ -0,0 +1,42 @@
+package main
+
+import (
+	"gotorrent/client"
+	"gotorrent/p2p"
+	"gotorrent/ratelimit"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	defer client.DownloadLimit.SetRate(0)
+	defer client.UploadLimit.SetRate(0)
+	tor := &p2p.Torrent{DownloadLimit: ratelimit.New(0), UploadLimit: ratelimit.New(0)}
+
+	for _, line := range []string{"dl 100", " ul  200 ", "tdl 50", "tul 0"} {
+		_, err := runCommand(line, tor)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	if client.DownloadLimit.Rate() != 100*1024 || client.UploadLimit.Rate() != 200*1024 {
+		t.Error("global limits not changed")
+	}
+	if tor.DownloadLimit.Rate() != 50*1024 || tor.UploadLimit.Rate() != 0 {
+		t.Error("torrent limits not changed")
+	}
+
+	reply, err := runCommand("limits", tor)
+	if err != nil || !strings.Contains(reply, "download 100 KiB/s") || !strings.Contains(reply, "torrent upload unlimited") {
+		t.Errorf("limits printed %q, %v", reply, err)
+	}
+
+	for _, line := range []string{"dl", "dl -5", "dl fast", "up 10", "limits now"} {
+		if _, err := runCommand(line, tor); err == nil {
+			t.Errorf("%q was accepted", line)
+		}
+	}
+	if client.DownloadLimit.Rate() != 100*1024 {
+		t.Error("a rejected command changed a limit")
+	}
+}
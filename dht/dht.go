@@ -0,0 +1,511 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gotorrent/torrentfile"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// well known nodes used to join the network when we know no other nodes
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	queryTimeout = 5 * time.Second
+	// how often the token secret changes, tokens from the previous secret
+	// are still accepted
+	tokenRotation = 5 * time.Minute
+	// announced peers are forgotten unless they announce again
+	peerExpiry = 30 * time.Minute
+	// peers returned per get_peers response so it fits in one packet
+	maxValues = 50
+	// how often buckets are checked for refreshing
+	maintenanceInterval = time.Minute
+)
+
+var errQueryTimeout = errors.New("DHT query timed out")
+
+var errClosed = errors.New("DHT is closed")
+
+type Config struct {
+	// UDP port to listen on, 0 picks a free port
+	Port uint16
+	// a socket shared with other protocols, such as the uTP socket peers
+	// connect to, used instead of listening on Port. It is left open on Close
+	Conn net.PacketConn
+	// file the node id and routing table are kept in between runs, nothing
+	// is saved when empty
+	StatePath string
+	// nodes to join the network through, DefaultBootstrap when nil
+	Bootstrap []string
+}
+
+// DHT is a node of the mainline DHT (BEP 5), it answers queries from other
+// nodes and finds peers for infohashes
+type DHT struct {
+	ID   [20]byte
+	Port uint16
+
+	conn      net.PacketConn
+	shared    bool
+	table     *routingTable
+	statePath string
+	bootstrap []string
+	// nodes from the last run, tried before the bootstrap nodes
+	saved       []*contact
+	bootstrapMu sync.Mutex
+
+	mu      sync.Mutex
+	nextTID uint16
+	pending map[string]*pendingQuery
+	secrets [2][16]byte
+	// peers announced to us, keyed by infohash and then address
+	peers map[[20]byte]map[string]storedPeer
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pendingQuery struct {
+	addr *net.UDPAddr
+	resp chan *krpcMsg
+}
+
+type storedPeer struct {
+	peer  torrentfile.Peer
+	added time.Time
+}
+
+type bencodeState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// starts a DHT node, reusing the node id and routing table saved at
+// cfg.StatePath by a previous run when there is one
+func New(cfg Config) (*DHT, error) {
+	conn := cfg.Conn
+	if conn == nil {
+		var err error
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: int(cfg.Port)})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DHT{
+		Port:      uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		conn:      conn,
+		shared:    cfg.Conn != nil,
+		statePath: cfg.StatePath,
+		bootstrap: cfg.Bootstrap,
+		pending:   make(map[string]*pendingQuery),
+		peers:     make(map[[20]byte]map[string]storedPeer),
+		closed:    make(chan struct{}),
+	}
+	if d.bootstrap == nil {
+		d.bootstrap = DefaultBootstrap
+	}
+
+	err := d.loadState()
+	if err != nil {
+		_, err = rand.Read(d.ID[:])
+		if err != nil {
+			d.closeConn()
+			return nil, err
+		}
+	}
+	d.table = newRoutingTable(d.ID)
+
+	_, err = rand.Read(d.secrets[0][:])
+	if err != nil {
+		d.closeConn()
+		return nil, err
+	}
+	d.secrets[1] = d.secrets[0]
+
+	go d.readLoop()
+	go d.maintain()
+	return d, nil
+}
+
+func (d *DHT) loadState() error {
+	if d.statePath == "" {
+		return fmt.Errorf("No DHT state file")
+	}
+	f, err := os.Open(d.statePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state := bencodeState{}
+	err = bencode.Unmarshal(f, &state)
+	if err != nil {
+		return err
+	}
+	if len(state.ID) != 20 {
+		return fmt.Errorf("DHT state has a node id of %d bytes", len(state.ID))
+	}
+	copy(d.ID[:], state.ID)
+
+	d.saved, err = decodeNodes(state.Nodes)
+	return err
+}
+
+// writes the node id and routing table to the state file
+func (d *DHT) Save() error {
+	if d.statePath == "" {
+		return nil
+	}
+
+	state := bencodeState{
+		ID:    string(d.ID[:]),
+		Nodes: encodeNodes(d.table.closest(d.ID, 160*k)),
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, state)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(d.statePath+".tmp", buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(d.statePath+".tmp", d.statePath)
+}
+
+// saves the routing table and stops the node
+func (d *DHT) Close() error {
+	err := d.Save()
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		d.closeConn()
+	})
+	return err
+}
+
+// a shared socket stays open for its other users, the read loop is woken up
+// to notice the node closed instead
+func (d *DHT) closeConn() {
+	if d.shared {
+		d.conn.SetReadDeadline(time.Now())
+		return
+	}
+	d.conn.Close()
+}
+
+// the number of nodes in the routing table
+func (d *DHT) Nodes() int {
+	return d.table.size()
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, addr)
+		default:
+			d.handleResponse(msg, addr)
+		}
+	}
+}
+
+func (d *DHT) handleResponse(msg *krpcMsg, addr *net.UDPAddr) {
+	d.mu.Lock()
+	pq, ok := d.pending[msg.T]
+	if ok && pq.addr.IP.Equal(addr.IP) && pq.addr.Port == addr.Port {
+		delete(d.pending, msg.T)
+	} else {
+		ok = false
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if msg.Y == "r" {
+		if id, ok := getID(msg.R, "id"); ok {
+			d.table.seen(id, addr)
+		}
+	}
+	pq.resp <- msg
+}
+
+// sends a query and waits for the response, KRPC errors are returned as errors
+func (d *DHT) query(addr *net.UDPAddr, q string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(d.ID[:])
+
+	d.mu.Lock()
+	d.nextTID++
+	tid := string(binary.BigEndian.AppendUint16(nil, d.nextTID))
+	pq := &pendingQuery{addr: addr, resp: make(chan *krpcMsg, 1)}
+	d.pending[tid] = pq
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	data, err := encodeQuery(tid, q, args)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.conn.WriteTo(data, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-pq.resp:
+		if msg.Y == "e" {
+			return nil, fmt.Errorf("DHT node %s returned error %v", addr, msg.E)
+		}
+		return msg.R, nil
+	case <-timer.C:
+		return nil, errQueryTimeout
+	case <-d.closed:
+		return nil, errClosed
+	}
+}
+
+func (d *DHT) sendError(t string, code int, message string, addr *net.UDPAddr) {
+	data, err := encodeError(t, code, message)
+	if err != nil {
+		return
+	}
+	d.conn.WriteTo(data, addr)
+}
+
+func (d *DHT) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	id, ok := getID(msg.A, "id")
+	if !ok {
+		d.sendError(msg.T, errProtocol, "Missing node id", addr)
+		return
+	}
+	d.table.seen(id, addr)
+
+	r := map[string]interface{}{"id": string(d.ID[:])}
+
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, ok := getID(msg.A, "target")
+		if !ok {
+			d.sendError(msg.T, errProtocol, "Missing target", addr)
+			return
+		}
+		r["nodes"] = encodeNodes(d.table.closest(target, k))
+	case "get_peers":
+		infohash, ok := getID(msg.A, "info_hash")
+		if !ok {
+			d.sendError(msg.T, errProtocol, "Missing info_hash", addr)
+			return
+		}
+		r["token"] = d.token(addr.IP, 0)
+		peers := d.storedPeers(infohash)
+		if len(peers) > 0 {
+			r["values"] = encodePeers(peers)
+		} else {
+			r["nodes"] = encodeNodes(d.table.closest(infohash, k))
+		}
+	case "announce_peer":
+		infohash, ok := getID(msg.A, "info_hash")
+		if !ok {
+			d.sendError(msg.T, errProtocol, "Missing info_hash", addr)
+			return
+		}
+		token, _ := msg.A["token"].(string)
+		if !d.validToken(token, addr.IP) {
+			d.sendError(msg.T, errProtocol, "Bad token", addr)
+			return
+		}
+		port, _ := msg.A["port"].(int64)
+		if implied, _ := msg.A["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(msg.T, errProtocol, "Bad port", addr)
+			return
+		}
+		d.storePeer(infohash, torrentfile.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		d.sendError(msg.T, errMethodUnknown, "Method Unknown", addr)
+		return
+	}
+
+	data, err := encodeResponse(msg.T, r)
+	if err != nil {
+		return
+	}
+	d.conn.WriteTo(data, addr)
+}
+
+// tokens prove a node asked us for peers from its address before announcing
+func (d *DHT) token(ip net.IP, secret int) string {
+	d.mu.Lock()
+	s := d.secrets[secret]
+	d.mu.Unlock()
+
+	h := sha1.New()
+	h.Write(s[:])
+	h.Write(ip.To4())
+	return string(h.Sum(nil)[:8])
+}
+
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	return token != "" && (token == d.token(ip, 0) || token == d.token(ip, 1))
+}
+
+func (d *DHT) rotateSecret() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.secrets[1] = d.secrets[0]
+	rand.Read(d.secrets[0][:])
+}
+
+func (d *DHT) storePeer(infohash [20]byte, peer torrentfile.Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.peers[infohash] == nil {
+		d.peers[infohash] = make(map[string]storedPeer)
+	}
+	d.peers[infohash][peer.String()] = storedPeer{peer: peer, added: time.Now()}
+}
+
+func (d *DHT) storedPeers(infohash [20]byte) []torrentfile.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var peers []torrentfile.Peer
+	for _, sp := range d.peers[infohash] {
+		if len(peers) == maxValues {
+			break
+		}
+		peers = append(peers, sp.peer)
+	}
+	return peers
+}
+
+func (d *DHT) expirePeers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for infohash, peers := range d.peers {
+		for key, sp := range peers {
+			if time.Since(sp.added) > peerExpiry {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infohash)
+		}
+	}
+}
+
+// keeps the routing table filled and the token secret fresh
+func (d *DHT) maintain() {
+	d.joinNetwork()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	lastRotation := time.Now()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(lastRotation) > tokenRotation {
+			d.rotateSecret()
+			lastRotation = time.Now()
+		}
+		d.expirePeers()
+
+		if d.table.size() < k {
+			d.joinNetwork()
+			continue
+		}
+		for _, bucket := range d.table.staleBuckets() {
+			d.lookup(randomIDInBucket(d.ID, bucket), "find_node", nil)
+		}
+	}
+}
+
+// fills the routing table by looking up our own id through the nodes saved
+// from the last run and the bootstrap nodes
+func (d *DHT) joinNetwork() {
+	d.bootstrapMu.Lock()
+	defer d.bootstrapMu.Unlock()
+
+	if d.table.size() >= k {
+		return
+	}
+
+	seeds := append([]*contact{}, d.saved...)
+	for _, host := range d.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			continue
+		}
+		seeds = append(seeds, &contact{addr: addr})
+	}
+	d.lookup(d.ID, "find_node", seeds)
+}
+
+// a random id sharing exactly the given number of leading bits with self
+func randomIDInBucket(self [20]byte, bucket int) [20]byte {
+	var id [20]byte
+	rand.Read(id[:])
+	for i := 0; i < bucket; i++ {
+		mask := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^mask | self[i/8]&mask
+	}
+	if bucket < 160 {
+		mask := byte(0x80) >> (bucket % 8)
+		id[bucket/8] = id[bucket/8]&^mask | ^self[bucket/8]&mask
+	}
+	return id
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"fmt"
+	"gotorrent/torrentfile"
+	"net"
+	"testing"
+)
+
+// starts n loopback nodes, the first one knows nobody and the rest join the
+// network through it
+func testSwarm(t *testing.T, n int) []*DHT {
+	t.Helper()
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		bootstrap := []string{}
+		if i > 0 {
+			bootstrap = []string{fmt.Sprintf("127.0.0.1:%d", nodes[0].Port)}
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := New(Config{Conn: conn, Bootstrap: bootstrap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			d.Close()
+			conn.Close()
+		})
+		nodes = append(nodes, d)
+	}
+	for _, d := range nodes[1:] {
+		d.joinNetwork()
+	}
+	return nodes
+}
+
+func addrOf(d *DHT) *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func hasPeer(peers []torrentfile.Peer, want torrentfile.Peer) bool {
+	for _, p := range peers {
+		if p.String() == want.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSwarmFindsAnnouncedPeer(t *testing.T) {
+	nodes := testSwarm(t, 8)
+	for i, d := range nodes {
+		if d.Nodes() == 0 {
+			t.Fatalf("node %d has an empty routing table", i)
+		}
+	}
+	// the nodes joined through the first one but learned about each other
+	if nodes[7].Nodes() < 2 {
+		t.Errorf("last node only knows %d nodes", nodes[7].Nodes())
+	}
+
+	infohash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	peers, err := nodes[3].GetPeers(infohash, 7777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("found %v before anyone announced", peers)
+	}
+
+	peers, err = nodes[6].GetPeers(infohash, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := torrentfile.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 7777}
+	if !hasPeer(peers, want) {
+		t.Errorf("got peers %v, want %s", peers, want.String())
+	}
+}
+
+func TestAnnounceNeedsValidToken(t *testing.T) {
+	nodes := testSwarm(t, 2)
+	server, asker := nodes[0], nodes[1]
+	infohash := [20]byte{1, 2, 3}
+
+	announce := func(from *DHT, token string) error {
+		_, err := from.query(addrOf(server), "announce_peer", map[string]interface{}{
+			"info_hash": string(infohash[:]),
+			"port":      6881,
+			"token":     token,
+		})
+		return err
+	}
+
+	r, err := asker.query(addrOf(server), "get_peers", map[string]interface{}{"info_hash": string(infohash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := r["token"].(string)
+	if token == "" {
+		t.Fatal("get_peers response has no token")
+	}
+
+	if announce(asker, "bogus") == nil {
+		t.Error("announce with a made up token was accepted")
+	}
+
+	// tokens are bound to the ip they were handed out to
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	impostor, err := New(Config{Conn: conn, Bootstrap: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+	defer conn.Close()
+	if announce(impostor, token) == nil {
+		t.Error("token was accepted from another ip")
+	}
+	if len(server.storedPeers(infohash)) != 0 {
+		t.Fatal("a rejected announce stored a peer")
+	}
+
+	// the previous secret is still accepted after one rotation
+	server.rotateSecret()
+	err = announce(asker, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := torrentfile.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	if !hasPeer(server.storedPeers(infohash), want) {
+		t.Errorf("stored %v after a valid announce", server.storedPeers(infohash))
+	}
+
+	server.rotateSecret()
+	if announce(asker, token) == nil {
+		t.Error("token was accepted after its secret rotated out")
+	}
+}
+
+func TestImpliedPort(t *testing.T) {
+	nodes := testSwarm(t, 2)
+	server, asker := nodes[0], nodes[1]
+	infohash := [20]byte{4, 5, 6}
+
+	r, err := asker.query(addrOf(server), "get_peers", map[string]interface{}{"info_hash": string(infohash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = asker.query(addrOf(server), "announce_peer", map[string]interface{}{
+		"info_hash":    string(infohash[:]),
+		"port":         1,
+		"implied_port": 1,
+		"token":        r["token"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := torrentfile.Peer{IP: net.IPv4(127, 0, 0, 1), Port: asker.Port}
+	if !hasPeer(server.storedPeers(infohash), want) {
+		t.Errorf("stored %v, want the port the query came from", server.storedPeers(infohash))
+	}
+}
@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"gotorrent/torrentfile"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC error codes (BEP 5)
+const (
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// a decoded KRPC message, queries carry q and a, responses r and errors e
+type krpcMsg struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E []interface{}
+}
+
+func decodeMsg(data []byte) (*krpcMsg, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	msg := &krpcMsg{}
+	msg.T, _ = dict["t"].(string)
+	msg.Y, _ = dict["y"].(string)
+	msg.Q, _ = dict["q"].(string)
+	msg.A, _ = dict["a"].(map[string]interface{})
+	msg.R, _ = dict["r"].(map[string]interface{})
+	msg.E, _ = dict["e"].([]interface{})
+
+	if msg.T == "" {
+		return nil, fmt.Errorf("KRPC message has no transaction id")
+	}
+	switch msg.Y {
+	case "q":
+		if msg.A == nil {
+			return nil, fmt.Errorf("KRPC query has no arguments")
+		}
+	case "r":
+		if msg.R == nil {
+			return nil, fmt.Errorf("KRPC response has no return values")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("Unknown KRPC message type %q", msg.Y)
+	}
+	return msg, nil
+}
+
+func encodeQuery(t, q string, a map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{"t": t, "y": "q", "q": q, "a": a})
+	return buf.Bytes(), err
+}
+
+func encodeResponse(t string, r map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{"t": t, "y": "r", "r": r})
+	return buf.Bytes(), err
+}
+
+func encodeError(t string, code int, message string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{"t": t, "y": "e", "e": []interface{}{code, message}})
+	return buf.Bytes(), err
+}
+
+// reads a 20 byte id such as a node id or infohash out of a dictionary
+func getID(dict map[string]interface{}, key string) ([20]byte, bool) {
+	var id [20]byte
+	s, ok := dict[key].(string)
+	if !ok || len(s) != 20 {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// compact node info is the 20 byte node id followed by compact ip and port
+const compactNodeSize = 26
+
+func encodeNodes(contacts []*contact) string {
+	buf := make([]byte, 0, len(contacts)*compactNodeSize)
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, c.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(c.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(s string) ([]*contact, error) {
+	if len(s)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("Received malformed compact nodes")
+	}
+	contacts := make([]*contact, 0, len(s)/compactNodeSize)
+	for offset := 0; offset < len(s); offset += compactNodeSize {
+		c := &contact{
+			addr: &net.UDPAddr{
+				IP:   net.IP([]byte(s[offset+20 : offset+24])),
+				Port: int(binary.BigEndian.Uint16([]byte(s[offset+24 : offset+26]))),
+			},
+		}
+		copy(c.id[:], s[offset:offset+20])
+		if c.addr.Port == 0 {
+			continue
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
+// peers in get_peers responses are a list of 6 byte compact peers
+func encodePeers(peers []torrentfile.Peer) []interface{} {
+	values := make([]interface{}, 0, len(peers))
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf := make([]byte, 0, 6)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+		values = append(values, string(buf))
+	}
+	return values
+}
+
+func decodePeers(values []interface{}) []torrentfile.Peer {
+	peers := make([]torrentfile.Peer, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		peers = append(peers, torrentfile.Peer{
+			IP:   net.IP([]byte(s[0:4])),
+			Port: binary.BigEndian.Uint16([]byte(s[4:6])),
+		})
+	}
+	return peers
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"fmt"
+	"gotorrent/torrentfile"
+	"sort"
+	"sync"
+)
+
+// number of queries in flight at once during a lookup
+const alpha = 3
+
+// upper bound on lookup rounds in case the network keeps returning new nodes
+const maxRounds = 32
+
+type lookupNode struct {
+	c         *contact
+	queried   bool
+	responded bool
+	token     string
+}
+
+type lookupResult struct {
+	node *lookupNode
+	r    map[string]interface{}
+	err  error
+}
+
+// walks the network towards target querying the closest nodes found so far
+// with q, either find_node or get_peers. Returns the peers found and the
+// closest nodes that answered
+func (d *DHT) lookup(target [20]byte, q string, seeds []*contact) ([]torrentfile.Peer, []*lookupNode) {
+	if seeds == nil {
+		seeds = d.table.closest(target, k)
+	}
+
+	var shortlist []*lookupNode
+	known := make(map[string]bool)
+	add := func(c *contact) {
+		key := c.addr.String()
+		if known[key] || c.id == d.ID {
+			return
+		}
+		known[key] = true
+		shortlist = append(shortlist, &lookupNode{c: c})
+	}
+	for _, c := range seeds {
+		add(c)
+	}
+
+	var peers []torrentfile.Peer
+	seenPeers := make(map[string]bool)
+
+	for round := 0; round < maxRounds; round++ {
+		sort.SliceStable(shortlist, func(i, j int) bool {
+			return closer(target, shortlist[i].c.id, shortlist[j].c.id)
+		})
+
+		// query the closest unqueried nodes, the lookup is done once the k
+		// closest nodes still in the running have all been queried
+		var batch []*lookupNode
+		considered := 0
+		for _, n := range shortlist {
+			if considered == k || len(batch) == alpha {
+				break
+			}
+			if n.queried && !n.responded {
+				continue
+			}
+			considered++
+			if !n.queried {
+				batch = append(batch, n)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make([]lookupResult, len(batch))
+		var wg sync.WaitGroup
+		for i, n := range batch {
+			n.queried = true
+			wg.Add(1)
+			go func(i int, n *lookupNode) {
+				defer wg.Done()
+				args := map[string]interface{}{}
+				if q == "get_peers" {
+					args["info_hash"] = string(target[:])
+				} else {
+					args["target"] = string(target[:])
+				}
+				r, err := d.query(n.c.addr, q, args)
+				results[i] = lookupResult{node: n, r: r, err: err}
+			}(i, n)
+		}
+		wg.Wait()
+
+		for _, res := range results {
+			n := res.node
+			if res.err != nil {
+				if n.c.id != ([20]byte{}) {
+					d.table.failed(n.c.id)
+				}
+				continue
+			}
+			n.responded = true
+			if id, ok := getID(res.r, "id"); ok {
+				n.c.id = id
+			}
+			n.token, _ = res.r["token"].(string)
+
+			if values, ok := res.r["values"].([]interface{}); ok {
+				for _, p := range decodePeers(values) {
+					if !seenPeers[p.String()] {
+						seenPeers[p.String()] = true
+						peers = append(peers, p)
+					}
+				}
+			}
+			if nodes, ok := res.r["nodes"].(string); ok {
+				contacts, err := decodeNodes(nodes)
+				if err != nil {
+					continue
+				}
+				for _, c := range contacts {
+					add(c)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(shortlist, func(i, j int) bool {
+		return closer(target, shortlist[i].c.id, shortlist[j].c.id)
+	})
+	var closest []*lookupNode
+	for _, n := range shortlist {
+		if len(closest) == k {
+			break
+		}
+		if n.responded {
+			closest = append(closest, n)
+		}
+	}
+	return peers, closest
+}
+
+// finds peers for the infohash. When port isn't 0 we also announce that we
+// accept connections for the torrent on that port to the closest nodes
+func (d *DHT) GetPeers(infohash [20]byte, port uint16) ([]torrentfile.Peer, error) {
+	if d.table.size() == 0 {
+		d.joinNetwork()
+	}
+	if d.table.size() == 0 {
+		return nil, fmt.Errorf("Could not reach any DHT nodes")
+	}
+
+	peers, closest := d.lookup(infohash, "get_peers", nil)
+
+	if port != 0 {
+		var wg sync.WaitGroup
+		for _, n := range closest {
+			if n.token == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(n *lookupNode) {
+				defer wg.Done()
+				d.query(n.c.addr, "announce_peer", map[string]interface{}{
+					"info_hash": string(infohash[:]),
+					"port":      int(port),
+					"token":     n.token,
+				})
+			}(n)
+		}
+		wg.Wait()
+	}
+
+	return peers, nil
+}
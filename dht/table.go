@@ -0,0 +1,175 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of nodes kept per bucket and returned from lookups
+const k = 8
+
+// a node that hasn't been heard from in this long may be replaced
+const staleAfter = 15 * time.Minute
+
+// a node is dropped after failing to answer this many queries in a row
+const maxFailures = 2
+
+type contact struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func xor(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// true when a is closer to target than b
+func closer(target, a, b [20]byte) bool {
+	da := xor(target, a)
+	db := xor(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// the number of leading bits id shares with self, ids sharing more bits are
+// closer and share a bucket with fewer nodes competing for it
+func commonPrefix(self, id [20]byte) int {
+	d := xor(self, id)
+	for i, b := range d {
+		if b == 0 {
+			continue
+		}
+		n := i * 8
+		for mask := byte(0x80); b&mask == 0; mask >>= 1 {
+			n++
+		}
+		return n
+	}
+	return 160
+}
+
+// a k-bucket routing table, bucket i holds nodes whose ids share exactly i
+// leading bits with our own id
+type routingTable struct {
+	self    [20]byte
+	mu      sync.Mutex
+	buckets [160][]*contact
+}
+
+func newRoutingTable(self [20]byte) *routingTable {
+	return &routingTable{self: self}
+}
+
+// records that a node is alive. Unknown nodes are added while their bucket has
+// room or takes the place of a stale node, otherwise they are ignored since
+// long lived nodes are the most likely to stay around
+func (rt *routingTable) seen(id [20]byte, addr *net.UDPAddr) {
+	if id == rt.self || addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	i := commonPrefix(rt.self, id)
+	bucket := rt.buckets[i]
+	for j, c := range bucket {
+		if c.id == id {
+			c.addr = addr
+			c.lastSeen = time.Now()
+			c.failures = 0
+			// most recently seen nodes live at the end of the bucket
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return
+		}
+	}
+
+	c := &contact{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < k {
+		rt.buckets[i] = append(bucket, c)
+		return
+	}
+	for j, old := range bucket {
+		if old.failures > 0 || time.Since(old.lastSeen) > staleAfter {
+			rt.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), c)
+			return
+		}
+	}
+}
+
+// counts a query the node didn't answer, dropping it after too many
+func (rt *routingTable) failed(id [20]byte) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	i := commonPrefix(rt.self, id)
+	if i == 160 {
+		return
+	}
+	bucket := rt.buckets[i]
+	for j, c := range bucket {
+		if c.id == id {
+			c.failures++
+			if c.failures >= maxFailures {
+				rt.buckets[i] = append(bucket[:j:j], bucket[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// the n known nodes closest to target
+func (rt *routingTable) closest(target [20]byte, n int) []*contact {
+	rt.mu.Lock()
+	var all []*contact
+	for _, bucket := range rt.buckets {
+		for _, c := range bucket {
+			all = append(all, &contact{id: c.id, addr: c.addr})
+		}
+	}
+	rt.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return closer(target, all[i].id, all[j].id)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// buckets that haven't seen any activity recently, refreshed by looking up a
+// random id that falls into them
+func (rt *routingTable) staleBuckets() []int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var stale []int
+	for i, bucket := range rt.buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		newest := bucket[len(bucket)-1]
+		if time.Since(newest.lastSeen) > staleAfter {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
@@ -1,38 +1,75 @@
 package file
 
 import (
+	"fmt"
 	"gotorrent/torrentfile"
 	"os"
 	"path/filepath"
 )
 
+// File is the on disk storage of a torrent, a single file torrent is backed by
+// one .gtor file while a multi file torrent is backed by a directory tree with
+// one os.File per file in the torrent
 type File struct {
-	File *os.File
+	// the .gtor file or root directory of the download
+	Path   string
+	Files  []*os.File
+	layout []torrentfile.File
 }
 
 func New(path string, tf torrentfile.TorrentFile) (*File, error) {
-
-	f, err := AllocateFile(path, tf.Name, tf.Length)
+	// the name becomes the file or directory created under path
+	root, err := filePath(path, []string{tf.Name})
 	if err != nil {
 		return nil, err
 	}
 
-	return &File{
-		File: f,
-	}, nil
+	if !tf.IsMultiFile() {
+		f, err := AllocateFile(path, tf.Name, tf.Length)
+		if err != nil {
+			return nil, err
+		}
+
+		// a fresh download makes any old resume data meaningless
+		os.Remove(resumePath(f.Name()))
 
+		return &File{
+			Path:   f.Name(),
+			Files:  []*os.File{f},
+			layout: singleLayout(tf),
+		}, nil
+	}
+
+	os.Remove(resumePath(root))
+	return openTree(root, tf, true)
 }
 
-func Open(path string) (*File, error) {
-	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+// opens a partial download, path is the .gtor file for single file torrents
+// or the root directory for multi file torrents
+func Open(path string, tf torrentfile.TorrentFile) (*File, error) {
+	if !tf.IsMultiFile() {
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		//check extension to gtor
+
+		return &File{
+			Path:   path,
+			Files:  []*os.File{f},
+			layout: singleLayout(tf),
+		}, nil
+	}
+
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	//check extension to gtor
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory but the torrent has multiple files", path)
+	}
 
-	return &File{
-		File: f,
-	}, nil
+	return openTree(path, tf, false)
 }
 
 func AllocateFile(path, name string, fileSize int) (*os.File, error) {
@@ -50,14 +87,102 @@ func AllocateFile(path, name string, fileSize int) (*os.File, error) {
 	return f, nil
 }
 
+// the whole torrent lives in one file regardless of the name in the torrent
+func singleLayout(tf torrentfile.TorrentFile) []torrentfile.File {
+	return []torrentfile.File{{Path: []string{tf.Name}, Length: tf.Length, Offset: 0}}
+}
+
+// joins the path components of a torrent file onto root, refusing anything
+// that would escape the root directory
+func filePath(root string, components []string) (string, error) {
+	path := root
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || filepath.Base(c) != c {
+			return "", fmt.Errorf("Invalid path component %q in torrent", c)
+		}
+		path = filepath.Join(path, c)
+	}
+	return path, nil
+}
+
+// opens or creates every file of a multi file torrent under root, files that
+// are missing or too short are truncated up to their full length
+func openTree(root string, tf torrentfile.TorrentFile, create bool) (*File, error) {
+	f := &File{
+		Path:   root,
+		Files:  make([]*os.File, 0, len(tf.Files)),
+		layout: tf.Files,
+	}
+
+	for _, tfile := range tf.Files {
+		path, err := filePath(root, tfile.Path)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		flags := os.O_RDWR | os.O_CREATE
+		if create {
+			flags |= os.O_TRUNC
+		}
+		osFile, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Files = append(f.Files, osFile)
+
+		info, err := osFile.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.Size() < int64(tfile.Length) {
+			err = osFile.Truncate(int64(tfile.Length))
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// calls fn for every file overlapping the torrent byte span [begin,end) with
+// the offset inside that file and the matching slice bounds of the span
+func (f *File) span(begin, end int, fn func(osFile *os.File, fileOffset int64, spanBegin, spanEnd int) error) error {
+	for i, tfile := range f.layout {
+		fileBegin := tfile.Offset
+		fileEnd := tfile.Offset + tfile.Length
+		if fileEnd <= begin || fileBegin >= end {
+			continue
+		}
+
+		overlapBegin := max(begin, fileBegin)
+		overlapEnd := min(end, fileEnd)
+
+		err := fn(f.Files[i], int64(overlapBegin-fileBegin), overlapBegin-begin, overlapEnd-begin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (f *File) ReadPieceFromFile(begin, end int) ([]byte, error) {
 	buf := make([]byte, end-begin)
-	_, err := f.File.Seek(int64(begin), 0)
-	if err != nil {
-		return nil, err
-	}
 
-	_, err = f.File.Read(buf)
+	err := f.span(begin, end, func(osFile *os.File, fileOffset int64, spanBegin, spanEnd int) error {
+		_, err := osFile.ReadAt(buf[spanBegin:spanEnd], fileOffset)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -66,15 +191,20 @@ func (f *File) ReadPieceFromFile(begin, end int) ([]byte, error) {
 
 func (f *File) WritePieceToFile(buf []byte, begin, end int) error {
 
-	_, err := f.File.Seek(int64(begin), 0)
-	if err != nil {
+	return f.span(begin, end, func(osFile *os.File, fileOffset int64, spanBegin, spanEnd int) error {
+		_, err := osFile.WriteAt(buf[spanBegin:spanEnd], fileOffset)
 		return err
-	}
+	})
+}
 
-	_, err = f.File.Write(buf)
-	if err != nil {
-		return err
+// closes every file backing the torrent, returning the first error
+func (f *File) Close() error {
+	var firstErr error
+	for _, osFile := range f.Files {
+		err := osFile.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-
-	return nil
+	return firstErr
 }
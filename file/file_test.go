@@ -0,0 +1,85 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"gotorrent/torrentfile"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// builds a torrent from an info dictionary the way a fetched magnet does
+func testTorrent(t *testing.T, info map[string]interface{}) torrentfile.TorrentFile {
+	t.Helper()
+	info["piece length"] = 16
+	if _, ok := info["pieces"]; !ok {
+		info["pieces"] = string(make([]byte, 20))
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := torrentfile.TorrentFile{InfoHash: sha1.Sum(buf.Bytes())}
+	err = tf.SetMetadata(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func TestNewRejectsBadNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "../x"} {
+		multi := testTorrent(t, map[string]interface{}{
+			"name":  name,
+			"files": []map[string]interface{}{{"length": 16, "path": []string{"f"}}},
+		})
+		single := testTorrent(t, map[string]interface{}{"name": name, "length": 16})
+
+		for _, tf := range []torrentfile.TorrentFile{multi, single} {
+			parent := t.TempDir()
+			out := filepath.Join(parent, "out")
+			os.Mkdir(out, 0755)
+
+			f, err := New(out, tf)
+			if err == nil {
+				f.Close()
+				t.Errorf("name %q (multi file %v) was accepted", name, tf.IsMultiFile())
+			}
+			entries, _ := os.ReadDir(out)
+			siblings, _ := os.ReadDir(parent)
+			if len(entries) != 0 || len(siblings) != 1 {
+				t.Errorf("name %q (multi file %v) created files", name, tf.IsMultiFile())
+			}
+		}
+	}
+}
+
+func TestNewMultiFileTree(t *testing.T) {
+	tf := testTorrent(t, map[string]interface{}{
+		"name": "dir",
+		"files": []map[string]interface{}{
+			{"length": 6, "path": []string{"a"}},
+			{"length": 10, "path": []string{"sub", "b"}},
+		},
+	})
+	out := t.TempDir()
+	f, err := New(out, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = f.WritePieceToFile([]byte("0123456789abcdef"), 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(filepath.Join(out, "dir", "a"))
+	b, _ := os.ReadFile(filepath.Join(out, "dir", "sub", "b"))
+	if string(a) != "012345" || string(b) != "6789abcdef" {
+		t.Errorf("piece split as %q and %q", a, b)
+	}
+}
@@ -0,0 +1,129 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"gotorrent/bitfield"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Resume is the fast resume data kept in a sidecar file next to a download so
+// resuming doesn't have to hash every piece again. Pieces are only trusted
+// while the files they live in still have the size and mtime recorded when
+// the resume data was written
+type Resume struct {
+	Have    bitfield.Bitfield
+	changed []bool
+	f       *File
+}
+
+type bencodeResumeFile struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"`
+}
+
+type bencodeResume struct {
+	InfoHash string              `bencode:"info hash"`
+	Bitfield string              `bencode:"bitfield"`
+	Files    []bencodeResumeFile `bencode:"files"`
+}
+
+func resumePath(path string) string {
+	return filepath.Clean(path) + ".resume"
+}
+
+// writes the verified pieces along with the current size and mtime of every
+// file, the data is synced first so the recorded mtimes cover it
+func (f *File) SaveResume(infohash [20]byte, have bitfield.Bitfield) error {
+	br := bencodeResume{
+		InfoHash: string(infohash[:]),
+		Bitfield: string(have),
+		Files:    make([]bencodeResumeFile, len(f.Files)),
+	}
+
+	for i, osFile := range f.Files {
+		err := osFile.Sync()
+		if err != nil {
+			return err
+		}
+		info, err := osFile.Stat()
+		if err != nil {
+			return err
+		}
+		br.Files[i] = bencodeResumeFile{
+			Size:  info.Size(),
+			MTime: info.ModTime().UnixNano(),
+		}
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, br)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves half a sidecar
+	path := resumePath(f.Path)
+	err = os.WriteFile(path+".tmp", buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// reads the resume data of the download, any error means the data can't be
+// used and every piece has to be checked
+func (f *File) LoadResume(infohash [20]byte, numPieces int) (*Resume, error) {
+	data, err := os.Open(resumePath(f.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	br := bencodeResume{}
+	err = bencode.Unmarshal(data, &br)
+	if err != nil {
+		return nil, err
+	}
+
+	if br.InfoHash != string(infohash[:]) {
+		return nil, fmt.Errorf("Resume data belongs to a different torrent")
+	}
+	if len(br.Bitfield) != len(bitfield.New(numPieces)) {
+		return nil, fmt.Errorf("Resume data has a bitfield of %d bytes for %d pieces", len(br.Bitfield), numPieces)
+	}
+	if len(br.Files) != len(f.Files) {
+		return nil, fmt.Errorf("Resume data has %d files but the torrent has %d", len(br.Files), len(f.Files))
+	}
+
+	r := &Resume{
+		Have:    bitfield.Bitfield(br.Bitfield),
+		changed: make([]bool, len(f.Files)),
+		f:       f,
+	}
+	for i, osFile := range f.Files {
+		info, err := osFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		r.changed[i] = info.Size() != br.Files[i].Size || info.ModTime().UnixNano() != br.Files[i].MTime
+	}
+	return r, nil
+}
+
+// true when none of the files overlapping the torrent byte span [begin,end)
+// changed since the resume data was written
+func (r *Resume) Unchanged(begin, end int) bool {
+	for i, tfile := range r.f.layout {
+		if tfile.Offset+tfile.Length <= begin || tfile.Offset >= end {
+			continue
+		}
+		if r.changed[i] {
+			return false
+		}
+	}
+	return true
+}
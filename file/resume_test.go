@@ -0,0 +1,103 @@
+package file
+
+import (
+	"bytes"
+	"gotorrent/bitfield"
+	"os"
+	"testing"
+	"time"
+)
+
+// a download of two 16 byte files, one piece each, with resume data saved
+// while only the second piece was had
+func resumedDownload(t *testing.T) (*File, [20]byte) {
+	t.Helper()
+	tf := testTorrent(t, map[string]interface{}{
+		"name":   "dir",
+		"pieces": string(make([]byte, 40)),
+		"files": []map[string]interface{}{
+			{"length": 16, "path": []string{"a"}},
+			{"length": 16, "path": []string{"b"}},
+		},
+	})
+	f, err := New(t.TempDir(), tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	have := bitfield.New(2)
+	have.SetPiece(1)
+	err = f.SaveResume(tf.InfoHash, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, tf.InfoHash
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	f, infohash := resumedDownload(t)
+
+	r, err := f.LoadResume(infohash, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.Have, []byte{0x40}) {
+		t.Errorf("loaded bitfield %08b, want piece 1", r.Have)
+	}
+	if !r.Unchanged(0, 16) || !r.Unchanged(16, 32) {
+		t.Error("files reported as changed right after saving")
+	}
+	if _, err := os.Stat(resumePath(f.Path) + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary resume file left behind")
+	}
+
+	if _, err := f.LoadResume([20]byte{1}, 2); err == nil {
+		t.Error("loaded the resume data of another torrent")
+	}
+	if _, err := f.LoadResume(infohash, 9); err == nil {
+		t.Error("loaded resume data for a different number of pieces")
+	}
+}
+
+func TestResumeNoticesChangedFiles(t *testing.T) {
+	f, infohash := resumedDownload(t)
+	// a file touched since the resume data was written
+	err := os.Chtimes(f.Files[0].Name(), time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := f.LoadResume(infohash, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Unchanged(0, 16) {
+		t.Error("piece in a file with a new mtime still trusted")
+	}
+	if !r.Unchanged(16, 32) {
+		t.Error("piece in an untouched file no longer trusted")
+	}
+	// spans covering both files
+	if r.Unchanged(8, 24) {
+		t.Error("piece across a changed file still trusted")
+	}
+
+	// and one that changed size, even with its mtime put back
+	info, err := f.Files[1].Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Files[1].Truncate(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(f.Files[1].Name(), info.ModTime(), info.ModTime())
+	r, err = f.LoadResume(infohash, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Unchanged(16, 32) {
+		t.Error("piece in a file with a new size still trusted")
+	}
+}
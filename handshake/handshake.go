@@ -5,8 +5,32 @@ import (
 	"io"
 )
 
+// Reserved are the eight reserved bytes of the handshake, each bit set
+// advertises support for a protocol extension
+type Reserved [8]byte
+
+// a bit of the reserved bytes counted from the left, so bit 0 is the high bit
+// of the first byte and bit 63 the low bit of the last
+type ReservedBit uint
+
+const (
+	// the extension protocol (BEP 10), reserved_byte[5] & 0x10
+	ExtensionProtocol ReservedBit = 43
+	// the fast extension (BEP 6), reserved_byte[7] & 0x04
+	FastExtension ReservedBit = 61
+)
+
+func (r *Reserved) Set(bit ReservedBit) {
+	r[bit/8] |= 0x80 >> (bit % 8)
+}
+
+func (r Reserved) Has(bit ReservedBit) bool {
+	return r[bit/8]&(0x80>>(bit%8)) != 0
+}
+
 type HandShake struct {
 	Pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -17,7 +41,7 @@ func (h *HandShake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 
@@ -46,14 +70,17 @@ func Read(r io.Reader) (*HandShake, error) {
 		return nil, err
 	}
 
+	var reserved Reserved
 	var infohash, peerID [20]byte
 
 	// copying the correct bytes into the buffers
+	copy(reserved[:], handshakebuf[pstrlen:pstrlen+8])
 	copy(infohash[:], handshakebuf[pstrlen+8:pstrlen+28])
 	copy(peerID[:], handshakebuf[pstrlen+28:])
 
 	handshake := HandShake{
 		Pstr:     string(handshakebuf[:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infohash,
 		PeerID:   peerID,
 	}
@@ -1,40 +1,183 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"gotorrent/client"
+	"gotorrent/dht"
+	"gotorrent/metadata"
+	"gotorrent/mse"
 	"gotorrent/p2p"
+	"gotorrent/ratelimit"
 	"gotorrent/torrentfile"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
+// exit codes when a signal ends the download before it completed
+const (
+	// the torrent stopped cleanly, downloaded pieces and resume data are saved
+	exitStopped = 3
+	// a second signal killed it without waiting for the shutdown to finish
+	exitForced = 4
+)
+
+// where state kept between runs goes, like the DHT node id and routing
+// table. Empty when there is no cache dir
+func cachePath(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	dir = filepath.Join(dir, "gotorrent")
+	if os.MkdirAll(dir, 0755) != nil {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
 func main() {
 
-	inPath := flag.String("t", "", "torrent file for download")
+	inPath := flag.String("t", "", "torrent file or magnet link for download")
 	outPath := flag.String("o", ".", "the download output path")
 	resumePath := flag.String("r", "", "input partial download gtor file to resume")
+	seed := flag.Bool("seed", false, "keep seeding once the download completes, use with -r to seed an already complete download")
+	metadataOnly := flag.Bool("m", false, "only fetch the metadata of a magnet link and save it as a .torrent file in the output path")
+	port := flag.Uint("p", 6881, "port to accept incoming peer connections on")
+	useDHT := flag.Bool("dht", true, "find peers through the mainline DHT on the same port over udp")
+	useUTP := flag.Bool("utp", true, "dial peers over uTP first and fall back to TCP")
+	encryption := flag.String("e", "preferred", "peer connection encryption: disabled, preferred or required")
+	downloadLimit := flag.Int("dl", 0, "download limit in KiB/s, 0 for unlimited")
+	uploadLimit := flag.Int("ul", 0, "upload limit in KiB/s, 0 for unlimited")
+	torrentDownloadLimit := flag.Int("tdl", 0, "download limit of the torrent in KiB/s on top of -dl, 0 for unlimited")
+	torrentUploadLimit := flag.Int("tul", 0, "upload limit of the torrent in KiB/s on top of -ul, 0 for unlimited")
 
 	flag.Parse()
 
-	tf, err := torrentfile.Open(*inPath)
+	if *inPath == "" {
+		panic(fmt.Errorf("No input file passed in"))
+	}
+
+	policy, err := mse.ParsePolicy(*encryption)
+	if err != nil {
+		panic(err)
+	}
+	client.Encryption = policy
+	client.DownloadLimit.SetRate(*downloadLimit * 1024)
+	client.UploadLimit.SetRate(*uploadLimit * 1024)
+
+	listener, err := p2p.Listen(uint16(*port))
 	if err != nil {
 		panic(err)
 	}
+	defer listener.Close()
+	go listener.Serve()
+	if *useUTP {
+		client.UTP = listener.UTP
+	}
+
+	var node *dht.DHT
+	if *useDHT {
+		node, err = dht.New(dht.Config{Conn: listener.UTP, StatePath: cachePath("dht.state")})
+		if err != nil {
+			panic(err)
+		}
+		defer node.Close()
+	}
 
-	peers, err := tf.RequestPeers()
+	var tf torrentfile.TorrentFile
+	var peers []torrentfile.Peer
 
-	t := p2p.Torrent{
-		Peers:  peers,
-		PeerID: tf.PeerID,
-		TF:     tf,
+	if strings.HasPrefix(*inPath, "magnet:") {
+		tf, err = torrentfile.ParseMagnet(*inPath)
+		if err != nil {
+			panic(err)
+		}
+
+		peers, err = tf.RequestPeers(listener.Port)
+		if node != nil {
+			// trackerless magnet links can only be resolved through the DHT
+			fmt.Println("Looking up peers in the DHT...")
+			dhtPeers, dhtErr := node.GetPeers(tf.InfoHash, listener.Port)
+			if dhtErr == nil && len(dhtPeers) > 0 {
+				peers = append(peers, dhtPeers...)
+				err = nil
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Println("Fetching metadata from peers...")
+		info, err := metadata.Fetch(peers, tf.PeerID, tf.InfoHash)
+		if err != nil {
+			panic(err)
+		}
+		err = tf.SetMetadata(info)
+		if err != nil {
+			panic(err)
+		}
+
+		if *metadataOnly {
+			path := filepath.Join(*outPath, filepath.Base(tf.Name+".torrent"))
+			err = tf.Save(path)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("Saved metadata to", path)
+			return
+		}
+	} else {
+		tf, err = torrentfile.Open(*inPath)
+		if err != nil {
+			panic(err)
+		}
+
+		peers, err = tf.RequestPeers(listener.Port)
 	}
 
-	if *inPath == "" {
-		panic(fmt.Errorf("No input file passed in"))
+	t := p2p.Torrent{
+		Peers:         peers,
+		PeerID:        tf.PeerID,
+		TF:            tf,
+		Seed:          *seed,
+		Listener:      listener,
+		DHT:           node,
+		DownloadLimit: ratelimit.New(*torrentDownloadLimit * 1024),
+		UploadLimit:   ratelimit.New(*torrentUploadLimit * 1024),
 	}
 
 	resume := *resumePath != ""
 
+	// the first signal stops the torrent gracefully, a second one forces it
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("\nPress Ctrl-C again to force quit")
+		t.Stop()
+		<-signals
+		fmt.Println("Forced quit")
+		os.Exit(exitForced)
+	}()
+
+	// the limits can be changed while the torrent runs by typing commands
+	go readCommands(os.Stdin, &t)
+
 	err = t.DownloadTorrent(*outPath, *resumePath, resume)
+	if errors.Is(err, p2p.ErrStopped) {
+		// os.Exit skips the deferred closes
+		if node != nil {
+			node.Close()
+		}
+		listener.Close()
+		fmt.Println(err)
+		os.Exit(exitStopped)
+	}
 	if err != nil {
 		fmt.Println(err)
 	}
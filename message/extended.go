@@ -0,0 +1,59 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ExtendedHandshake is the bencoded payload of extended message 0, sent by
+// both sides once the handshake advertised the extension protocol (BEP 10)
+type ExtendedHandshake struct {
+	// extension names mapped to the message id the sender wants to receive
+	// them with, an id of 0 turns an extension off
+	M map[string]int `bencode:"m"`
+	// the port the sender accepts connections on
+	P int `bencode:"p,omitempty"`
+	// client name and version
+	V string `bencode:"v,omitempty"`
+	// our address as the sender sees it, 4 or 16 bytes
+	YourIP string `bencode:"yourip,omitempty"`
+	// how many outstanding requests the sender queues before dropping them
+	Reqq int `bencode:"reqq,omitempty"`
+	// the size of the info dictionary for ut_metadata (BEP 9)
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+func FormatExtended(id uint8, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{id}, payload...)}
+}
+
+// splits an extended message into the extended message id and its payload
+func (m *Message) ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected to have the MsgExtended ID but got %d", msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Extended message has no extended message id")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func (hs *ExtendedHandshake) Serialize() ([]byte, error) {
+	if hs.M == nil {
+		hs.M = map[string]int{}
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *hs)
+	return buf.Bytes(), err
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	hs := ExtendedHandshake{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &hs)
+	if err != nil {
+		return nil, err
+	}
+	return &hs, nil
+}
@@ -18,6 +18,22 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	// fast extension (BEP 6)
+	MsgSuggest     messageID = 13
+	MsgHaveAll     messageID = 14
+	MsgHaveNone    messageID = 15
+	MsgReject      messageID = 16
+	MsgAllowedFast messageID = 17
+	// extension protocol (BEP 10)
+	MsgExtended messageID = 20
+)
+
+const (
+	// longest message accepted from a peer, a 128 KiB block (the most we
+	// serve) with its index, begin and id
+	MaxLength = 1<<17 + 9
+	// bitfields may be longer, this allows 8 million pieces
+	MaxBitfieldLength = 1<<20 + 1
 )
 
 type Message struct {
@@ -25,6 +41,41 @@ type Message struct {
 	Payload []byte
 }
 
+// a block of a piece as named by request, cancel and piece messages
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func blockPayload(b Block) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(b.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(b.Begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(b.Length))
+	return payload
+}
+
+func FormatRequest(b Block) *Message {
+	return &Message{ID: MsgRequest, Payload: blockPayload(b)}
+}
+
+func FormatCancel(b Block) *Message {
+	return &Message{ID: MsgCancel, Payload: blockPayload(b)}
+}
+
+func FormatReject(b Block) *Message {
+	return &Message{ID: MsgReject, Payload: blockPayload(b)}
+}
+
+// formats a message whose payload is a single piece index such as have,
+// suggest piece and allowed fast
+func FormatIndex(id messageID, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}
+}
+
 func (m *Message) ParseHavePiece(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("Expected to have the MsgHave ID but didn't")
@@ -35,6 +86,17 @@ func (m *Message) ParseHavePiece(msg *Message) (int, error) {
 	return int(binary.BigEndian.Uint32(msg.Payload)), nil
 }
 
+// parses the piece index of a suggest piece or allowed fast message
+func (m *Message) ParseIndex(msg *Message) (int, error) {
+	if msg.ID != MsgSuggest && msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("Expected to have the MsgSuggest or MsgAllowedFast ID but got %d", msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Expected payload len 4, got %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
 func (m *Message) ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
 		return 0, fmt.Errorf("Expected to have the MsgPiece ID but got %d", msg.ID)
@@ -59,6 +121,37 @@ func (m *Message) ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// splits a piece message into the block it carries and its data
+func (m *Message) ParseBlock(msg *Message) (Block, []byte, error) {
+	if msg.ID != MsgPiece {
+		return Block{}, nil, fmt.Errorf("Expected to have the MsgPiece ID but got %d", msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return Block{}, nil, fmt.Errorf("Message payload too short, %d < 8", len(msg.Payload))
+	}
+	data := msg.Payload[8:]
+	b := Block{
+		Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		Length: len(data),
+	}
+	return b, data, nil
+}
+
+// parses request, cancel and reject messages which all name a block
+func (m *Message) ParseRequest(msg *Message) (int, int, int, error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("Expected to have the MsgRequest, MsgCancel or MsgReject ID but got %d", msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload len 12, got %d", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 func (m *Message) Serialize() []byte {
 	if m == nil { // nil means keep alive
 		return make([]byte, 4)
@@ -82,16 +175,29 @@ func Read(r io.Reader) (*Message, error) {
 
 	length := binary.BigEndian.Uint32(lengthBuf)
 
-	//keep alive message
+	//keep alive message, returned as nil since an empty message would read as a choke
 	if length == 0 {
-		return &Message{}, nil
+		return nil, nil
 	}
 
-	messageBuf := make([]byte, length)
+	messageBuf := make([]byte, 1)
 	_, err = io.ReadFull(r, messageBuf)
 	if err != nil {
 		return nil, err
 	}
+	// the length comes from the peer, it may not make us allocate gigabytes
+	limit := uint32(MaxLength)
+	if messageID(messageBuf[0]) == MsgBitfield {
+		limit = MaxBitfieldLength
+	}
+	if length > limit {
+		return nil, fmt.Errorf("Message of %d bytes exceeds the limit of %d", length, limit)
+	}
+	messageBuf = append(messageBuf, make([]byte, length-1)...)
+	_, err = io.ReadFull(r, messageBuf[1:])
+	if err != nil {
+		return nil, err
+	}
 
 	m := Message{
 		ID:      messageID(messageBuf[0]),
@@ -0,0 +1,52 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// a message header claiming length bytes follow, with only the id sent
+func header(length uint32, id messageID) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, length)
+	return append(buf, byte(id))
+}
+
+func TestReadRejectsOversizedLength(t *testing.T) {
+	tests := []struct {
+		length uint32
+		id     messageID
+	}{
+		{0xffffffff, MsgPiece},
+		{MaxLength + 1, MsgPiece},
+		{MaxLength + 1, MsgExtended},
+		{MaxBitfieldLength + 1, MsgBitfield},
+	}
+	for _, tt := range tests {
+		_, err := Read(bytes.NewReader(header(tt.length, tt.id)))
+		if err == nil || !bytes.Contains([]byte(err.Error()), []byte("exceeds")) {
+			t.Errorf("length %d for id %d: got %v, want it refused", tt.length, tt.id, err)
+		}
+	}
+}
+
+func TestReadAcceptsLongestMessages(t *testing.T) {
+	for _, m := range []*Message{
+		{ID: MsgPiece, Payload: make([]byte, MaxLength-1)},
+		{ID: MsgBitfield, Payload: make([]byte, MaxBitfieldLength-1)},
+		{ID: MsgHave, Payload: []byte{0, 0, 0, 7}},
+	} {
+		got, err := Read(bytes.NewReader(m.Serialize()))
+		if err != nil {
+			t.Fatalf("id %d: %v", m.ID, err)
+		}
+		if got.ID != m.ID || !bytes.Equal(got.Payload, m.Payload) {
+			t.Errorf("id %d came back as id %d with %d bytes", m.ID, got.ID, len(got.Payload))
+		}
+	}
+
+	got, err := Read(bytes.NewReader([]byte{0, 0, 0, 0}))
+	if got != nil || err != nil {
+		t.Errorf("keep alive read as %v, %v", got, err)
+	}
+}
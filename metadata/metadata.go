@@ -0,0 +1,232 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"gotorrent/client"
+	"gotorrent/handshake"
+	"gotorrent/message"
+	"gotorrent/torrentfile"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	// metadata is exchanged in 16KiB pieces (BEP 9)
+	pieceSize = 16384
+
+	// refuse peers claiming absurdly large metadata
+	maxMetadataSize = 16 * 1024 * 1024
+
+	// the name the extension is registered under (BEP 9)
+	ExtensionName = "ut_metadata"
+
+	// peers fetched from at the same time
+	maxConcurrentPeers = 8
+
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// fetches the info dictionary of a torrent from a swarm using the ut_metadata
+// extension, the first peer to deliver metadata matching the infohash wins
+func Fetch(peers []torrentfile.Peer, peerID, infohash [20]byte) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("No peers to fetch metadata from")
+	}
+
+	peerQueue := make(chan torrentfile.Peer, len(peers))
+	for _, peer := range peers {
+		peerQueue <- peer
+	}
+	close(peerQueue)
+
+	results := make(chan []byte)
+	done := make(chan struct{})
+	workers := min(maxConcurrentPeers, len(peers))
+	finished := make(chan struct{}, workers)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer func() { finished <- struct{}{} }()
+			for peer := range peerQueue {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				info, err := fetchFromPeer(peer, peerID, infohash)
+				if err != nil {
+					fmt.Printf("Could not fetch metadata from peer %s: %v\n", peer.String(), err)
+					continue
+				}
+
+				select {
+				case results <- info:
+				case <-done:
+				}
+				return
+			}
+		}()
+	}
+
+	go func() {
+		for w := 0; w < workers; w++ {
+			<-finished
+		}
+		close(results)
+	}()
+
+	info, ok := <-results
+	close(done)
+	if !ok {
+		return nil, fmt.Errorf("None of the %d peers could provide the metadata", len(peers))
+	}
+	return info, nil
+}
+
+// the ut_metadata side of a connection we fetch metadata over
+type fetcher struct {
+	info     []byte
+	received []bool
+	// pieces still missing, the fetch is done once info is set and this is 0
+	remaining int
+}
+
+func fetchFromPeer(peer torrentfile.Peer, peerID, infohash [20]byte) ([]byte, error) {
+	c, err := client.Connect(peer, peerID, infohash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	if !c.Supports(handshake.ExtensionProtocol) {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	f := &fetcher{}
+	c.RegisterExtension(ExtensionName, f)
+	err = c.SendExtendedHandshake(message.ExtendedHandshake{})
+	if err != nil {
+		return nil, err
+	}
+
+	for f.info == nil || f.remaining > 0 {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		err = c.HandleExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sha1.Sum(f.info) != infohash {
+		return nil, fmt.Errorf("metadata does not match infohash %x", infohash)
+	}
+	return f.info, nil
+}
+
+// requests every piece of the metadata once the peer told us its size
+func (f *fetcher) Handshake(c *client.Client, hs *message.ExtendedHandshake) error {
+	if f.info != nil {
+		return nil
+	}
+	if hs.M[ExtensionName] == 0 {
+		return fmt.Errorf("peer does not support ut_metadata")
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > maxMetadataSize {
+		return fmt.Errorf("peer sent invalid metadata size %d", hs.MetadataSize)
+	}
+
+	f.info = make([]byte, hs.MetadataSize)
+	f.remaining = (hs.MetadataSize + pieceSize - 1) / pieceSize
+	f.received = make([]bool, f.remaining)
+	for piece := 0; piece < f.remaining; piece++ {
+		err := sendRequest(c, piece)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fetcher) Message(c *client.Client, payload []byte) error {
+	if f.info == nil {
+		return nil
+	}
+	piece, data, err := parseData(payload)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// the peer is asking us, we have nothing to give
+		return sendReject(c, piece)
+	}
+	if piece < 0 || piece >= len(f.received) {
+		return fmt.Errorf("peer sent metadata piece %d out of range", piece)
+	}
+	begin := piece * pieceSize
+	end := min(begin+pieceSize, len(f.info))
+	if len(data) != end-begin {
+		return fmt.Errorf("metadata piece %d has length %d, expected %d", piece, len(data), end-begin)
+	}
+	if !f.received[piece] {
+		copy(f.info[begin:end], data)
+		f.received[piece] = true
+		f.remaining--
+	}
+	return nil
+}
+
+func sendRequest(c *client.Client, piece int) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, metadataMessage{MsgType: msgRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return c.SendExtension(ExtensionName, buf.Bytes())
+}
+
+// a data message is a bencoded dictionary immediately followed by the piece,
+// requests from the peer are returned without data
+func parseData(payload []byte) (int, []byte, error) {
+	dictLen, err := torrentfile.ValueLength(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msg := metadataMessage{}
+	err = bencode.Unmarshal(bytes.NewReader(payload[:dictLen]), &msg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch msg.MsgType {
+	case msgRequest:
+		return msg.Piece, nil, nil
+	case msgData:
+		return msg.Piece, payload[dictLen:], nil
+	case msgReject:
+		return 0, nil, fmt.Errorf("peer rejected request for metadata piece %d", msg.Piece)
+	default:
+		return 0, nil, fmt.Errorf("unexpected ut_metadata message type %d", msg.MsgType)
+	}
+}
@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"bytes"
+	"gotorrent/client"
+	"gotorrent/message"
+	"gotorrent/torrentfile"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Server hands out the info dictionary of a torrent we have to peers that
+// only know its infohash, such as peers started from a magnet link
+type Server struct {
+	info []byte
+}
+
+func NewServer(info []byte) *Server {
+	return &Server{info: info}
+}
+
+func (s *Server) Handshake(c *client.Client, hs *message.ExtendedHandshake) error {
+	return nil
+}
+
+// answers requests with the piece asked for, data and reject messages are
+// only meaningful to a peer fetching from us so they are ignored
+func (s *Server) Message(c *client.Client, payload []byte) error {
+	dictLen, err := torrentfile.ValueLength(payload)
+	if err != nil {
+		return err
+	}
+	msg := metadataMessage{}
+	err = bencode.Unmarshal(bytes.NewReader(payload[:dictLen]), &msg)
+	if err != nil {
+		return err
+	}
+	if msg.MsgType != msgRequest {
+		return nil
+	}
+
+	begin := msg.Piece * pieceSize
+	if msg.Piece < 0 || begin >= len(s.info) {
+		return sendReject(c, msg.Piece)
+	}
+	end := min(begin+pieceSize, len(s.info))
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, metadataMessage{MsgType: msgData, Piece: msg.Piece, TotalSize: len(s.info)})
+	if err != nil {
+		return err
+	}
+	buf.Write(s.info[begin:end])
+	return c.SendExtension(ExtensionName, buf.Bytes())
+}
+
+func sendReject(c *client.Client, piece int) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, metadataMessage{MsgType: msgReject, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return c.SendExtension(ExtensionName, buf.Bytes())
+}
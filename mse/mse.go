@@ -0,0 +1,456 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether peer connections are encrypted
+type Policy int
+
+const (
+	// plaintext connections only, encrypted connections from peers are refused
+	Disabled Policy = iota
+	// outgoing connections are encrypted when the peer supports it and
+	// incoming connections may be either
+	Preferred
+	// only encrypted connections in both directions
+	Required
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	}
+	return Disabled, fmt.Errorf("Unknown encryption policy %q, expected disabled, preferred or required", s)
+}
+
+// the methods in crypto_provide and crypto_select
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+const (
+	// public keys are sent as 96 byte big endian numbers
+	keySize = 96
+	// the random padding after each public key is at most this long
+	maxPadLen = 512
+)
+
+// the 768 bit safe prime and generator the Diffie-Hellman exchange is done in
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+// the verification constant, 8 zero bytes
+var vc = make([]byte, 8)
+
+// the plaintext BitTorrent handshake starts with these 20 bytes
+var btProtocol = []byte("\x13BitTorrent protocol")
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	x := make([]byte, 20)
+	_, err := rand.Read(x)
+	if err != nil {
+		return nil, err
+	}
+	private := new(big.Int).SetBytes(x)
+	public := new(big.Int).Exp(generator, private, prime)
+	return &keyPair{private: private, public: public.FillBytes(make([]byte, keySize))}, nil
+}
+
+// the shared secret S from the other side's public key
+func (kp *keyPair) secret(theirs []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(theirs)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, fmt.Errorf("Peer sent an invalid public key")
+	}
+	return new(big.Int).Exp(y, kp.private, prime).FillBytes(make([]byte, keySize)), nil
+}
+
+func randomPad(max int) ([]byte, error) {
+	n := make([]byte, 2)
+	_, err := rand.Read(n)
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n))%(max+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// an RC4 stream keyed for one direction, the first 1024 bytes of keystream
+// are thrown away
+func newCipher(name string, s []byte, skey [20]byte) (*rc4.Cipher, error) {
+	c, err := rc4.NewCipher(hash([]byte(name), s, skey[:]))
+	if err != nil {
+		return nil, err
+	}
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c, nil
+}
+
+// reads from r until pattern was read, giving up after max bytes
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not find the encryption handshake in the stream")
+}
+
+// Conn is a peer connection after the encryption handshake, reads and
+// writes are decrypted and encrypted with RC4 unless plaintext was chosen
+type Conn struct {
+	net.Conn
+	r io.Reader
+	// nil when the payload is plaintext
+	enc, dec *rc4.Cipher
+	writeMu  sync.Mutex
+}
+
+// true when the payload stream is RC4 encrypted rather than plaintext
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+type decryptReader struct {
+	r   io.Reader
+	dec *rc4.Cipher
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, enc, dec *rc4.Cipher, selected uint32, initial []byte) *Conn {
+	c := &Conn{Conn: conn}
+	var r io.Reader = br
+	if selected == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+		r = &decryptReader{r: br, dec: dec}
+	}
+	c.r = io.MultiReader(bytes.NewReader(initial), r)
+	return c
+}
+
+// runs the encryption handshake as the side opening the connection, skey is
+// the infohash of the torrent. Deadlines are left to the caller
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disabled {
+		return nil, fmt.Errorf("Encryption is disabled")
+	}
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad(maxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(append([]byte{}, kp.public...), padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	yb := make([]byte, keySize)
+	_, err = io.ReadFull(br, yb)
+	if err != nil {
+		return nil, err
+	}
+	s, err := kp.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := newCipher("keyA", s, skey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newCipher("keyB", s, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	provide := uint32(cryptoRC4)
+	if policy == Preferred {
+		provide |= cryptoPlaintext
+	}
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S) and then
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA), IA) with no PadC
+	// and no initial payload
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	plain := make([]byte, 0, 16)
+	plain = append(plain, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = binary.BigEndian.AppendUint16(plain, 0)
+	plain = binary.BigEndian.AppendUint16(plain, 0)
+	enc.XORKeyStream(plain, plain)
+
+	msg := append(hash([]byte("req1"), s), req2...)
+	_, err = conn.Write(append(msg, plain...))
+	if err != nil {
+		return nil, err
+	}
+
+	// the receiver's answer starts with VC encrypted after its PadB
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	err = syncTo(br, encVC, maxPadLen+len(vc))
+	if err != nil {
+		return nil, err
+	}
+
+	// crypto_select and len(PadD)
+	answer := make([]byte, 6)
+	_, err = io.ReadFull(br, answer)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(answer, answer)
+	selected := binary.BigEndian.Uint32(answer[0:4])
+	if selected&provide == 0 || (selected != cryptoRC4 && selected != cryptoPlaintext) {
+		return nil, fmt.Errorf("Peer selected unsupported encryption method %d", selected)
+	}
+	padD := make([]byte, binary.BigEndian.Uint16(answer[4:6]))
+	if len(padD) > maxPadLen {
+		return nil, fmt.Errorf("Peer sent padding of %d bytes", len(padD))
+	}
+	_, err = io.ReadFull(br, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	return newConn(conn, br, enc, dec, selected, nil), nil
+}
+
+// runs the encryption handshake as the side that accepted the connection,
+// skeys are the infohashes of the torrents the peer may ask for
+func Receive(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, error) {
+	if policy == Disabled {
+		return nil, fmt.Errorf("Encryption is disabled")
+	}
+	br := bufio.NewReader(conn)
+	ya := make([]byte, keySize)
+	_, err := io.ReadFull(br, ya)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s, err := kp.secret(ya)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad(maxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(append([]byte{}, kp.public...), padB...))
+	if err != nil {
+		return nil, err
+	}
+
+	// HASH('req1', S) follows PadA
+	err = syncTo(br, hash([]byte("req1"), s), maxPadLen+sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the torrent from HASH('req2', SKEY) xor HASH('req3', S)
+	req := make([]byte, sha1.Size)
+	_, err = io.ReadFull(br, req)
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	found := false
+	var skey [20]byte
+	for _, candidate := range skeys {
+		req2 := hash([]byte("req2"), candidate[:])
+		match := true
+		for i := range req2 {
+			if req2[i]^req3[i] != req[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			skey = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Peer asked for an unknown torrent")
+	}
+
+	enc, err := newCipher("keyB", s, skey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newCipher("keyA", s, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	// ENCRYPT(VC, crypto_provide, len(PadC))
+	header := make([]byte, 14)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], vc) {
+		return nil, fmt.Errorf("Peer sent an invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:14]))
+	if len(padC) > maxPadLen {
+		return nil, fmt.Errorf("Peer sent padding of %d bytes", len(padC))
+	}
+	_, err = io.ReadFull(br, padC)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+
+	// ENCRYPT(len(IA), IA), the initial payload is usually the BitTorrent
+	// handshake and is handed back as the first bytes read from the stream
+	iaLen := make([]byte, 2)
+	_, err = io.ReadFull(br, iaLen)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(iaLen, iaLen)
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen))
+	_, err = io.ReadFull(br, ia)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != Required:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("Peer offered no acceptable encryption method, crypto_provide %d", provide)
+	}
+
+	// ENCRYPT(VC, crypto_select, len(PadD), PadD) with no PadD
+	answer := make([]byte, 0, 14)
+	answer = append(answer, vc...)
+	answer = binary.BigEndian.AppendUint32(answer, selected)
+	answer = binary.BigEndian.AppendUint16(answer, 0)
+	enc.XORKeyStream(answer, answer)
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, br, enc, dec, selected, ia), nil
+}
+
+// accepts an incoming peer connection of either kind, a plaintext BitTorrent
+// handshake is recognized by its first 20 bytes and anything else is taken
+// as the start of an encryption handshake. The returned connection yields
+// the peer's BitTorrent handshake
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (net.Conn, error) {
+	prefix := make([]byte, len(btProtocol))
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+	replayed := &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix), conn)}
+
+	if bytes.Equal(prefix, btProtocol) {
+		if policy == Required {
+			return nil, fmt.Errorf("Refusing plaintext connection from %s", conn.RemoteAddr())
+		}
+		return replayed, nil
+	}
+
+	if policy == Disabled {
+		return nil, fmt.Errorf("Refusing encrypted connection from %s", conn.RemoteAddr())
+	}
+	return Receive(replayed, skeys, policy)
+}
+
+// a connection whose first bytes were already read and are read again
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,277 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+var testKey = [20]byte{9, 9, 9}
+
+// keeps a copy of everything written so tests can look at the wire
+type tapConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *tapConn) wire() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.written.Bytes()...)
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedConn := <-accepted
+	t.Cleanup(func() {
+		dialed.Close()
+		acceptedConn.Close()
+	})
+	return dialed, acceptedConn
+}
+
+// sends data both ways and checks it arrives intact
+func exchange(t *testing.T, a, b net.Conn) {
+	t.Helper()
+	msg := bytes.Repeat([]byte("piece data "), 5000)
+	go a.Write(msg)
+	go b.Write(msg)
+
+	for _, c := range []net.Conn{a, b} {
+		got := make([]byte, len(msg))
+		_, err := io.ReadFull(c, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("data was garbled")
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		initiator, receiver Policy
+		ok, encrypted       bool
+	}{
+		// Disabled on the initiating side sends a plain BitTorrent handshake
+		{Disabled, Disabled, true, false},
+		{Disabled, Preferred, true, false},
+		{Disabled, Required, false, false},
+		{Preferred, Disabled, false, false},
+		{Preferred, Preferred, true, true},
+		{Preferred, Required, true, true},
+		{Required, Disabled, false, false},
+		{Required, Preferred, true, true},
+		{Required, Required, true, true},
+	}
+
+	for _, tt := range tests {
+		dialed, accepted := tcpPair(t)
+		tap := &tapConn{Conn: dialed}
+
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		received := make(chan result, 1)
+		go func() {
+			conn, err := Accept(accepted, [][20]byte{{1}, testKey}, tt.receiver)
+			if err != nil {
+				accepted.Close()
+			}
+			received <- result{conn, err}
+		}()
+
+		var initiated net.Conn = tap
+		var err error
+		if tt.initiator != Disabled {
+			initiated, err = Initiate(tap, testKey, tt.initiator)
+		}
+		if err == nil {
+			_, err = initiated.Write(append(btProtocol, "rest of the handshake"...))
+		}
+		r := <-received
+
+		if (err == nil && r.err == nil) != tt.ok {
+			t.Errorf("%v to %v: initiator error %v, receiver error %v", tt.initiator, tt.receiver, err, r.err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+
+		// the BitTorrent handshake comes out of the receiving side either way
+		first := make([]byte, len(btProtocol)+len("rest of the handshake"))
+		_, err = io.ReadFull(r.conn, first)
+		if err != nil || !bytes.Equal(first[:len(btProtocol)], btProtocol) {
+			t.Errorf("%v to %v: receiver read %q, %v", tt.initiator, tt.receiver, first, err)
+			continue
+		}
+		if m, ok := initiated.(*Conn); ok && m.Encrypted() != tt.encrypted {
+			t.Errorf("%v to %v: encrypted %v", tt.initiator, tt.receiver, m.Encrypted())
+		}
+		exchange(t, initiated, r.conn)
+
+		leaked := bytes.Contains(tap.wire(), []byte("piece data"))
+		if leaked == tt.encrypted {
+			t.Errorf("%v to %v: plaintext on the wire %v", tt.initiator, tt.receiver, leaked)
+		}
+	}
+}
+
+// answers an encryption handshake selecting the given method, like a peer
+// that only does the obfuscated handshake but prefers plaintext payloads
+func selectingReceiver(conn net.Conn, skey [20]byte, selected uint32) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	ya := make([]byte, keySize)
+	_, err := io.ReadFull(br, ya)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s, err := kp.secret(ya)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(kp.public)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syncTo(br, hash([]byte("req1"), s), maxPadLen+20)
+	if err != nil {
+		return nil, err
+	}
+	enc, _ := newCipher("keyB", s, skey)
+	dec, _ := newCipher("keyA", s, skey)
+	// req2 xor req3, VC, crypto_provide, len(PadC) and len(IA) all empty
+	rest := make([]byte, 20+8+4+2+2)
+	_, err = io.ReadFull(br, rest)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(rest[20:], rest[20:])
+
+	answer := append([]byte{}, vc...)
+	answer = binary.BigEndian.AppendUint32(answer, selected)
+	answer = binary.BigEndian.AppendUint16(answer, 0)
+	enc.XORKeyStream(answer, answer)
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, br, enc, dec, selected, nil), nil
+}
+
+func TestInitiatePlaintextSelected(t *testing.T) {
+	for _, policy := range []Policy{Preferred, Required} {
+		dialed, accepted := tcpPair(t)
+		received := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := selectingReceiver(accepted, testKey, cryptoPlaintext)
+			received <- conn
+		}()
+
+		conn, err := Initiate(dialed, testKey, policy)
+		peer := <-received
+		if policy == Required {
+			if err == nil {
+				t.Error("Required accepted a plaintext payload")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Encrypted() {
+			t.Error("payload is encrypted after the peer selected plaintext")
+		}
+		exchange(t, conn, peer)
+	}
+}
+
+func TestReceiveRefusesPlaintextOfferWhenRequired(t *testing.T) {
+	for _, policy := range []Policy{Preferred, Required} {
+		dialed, accepted := tcpPair(t)
+		received := make(chan error, 1)
+		go func() {
+			conn, err := Receive(accepted, [][20]byte{testKey}, policy)
+			if err == nil && conn.Encrypted() {
+				t.Error("receiver encrypted although only plaintext was offered")
+			}
+			if err != nil {
+				accepted.Close()
+			}
+			received <- err
+		}()
+
+		// the initiating half of the handshake offering plaintext only
+		kp, _ := newKeyPair()
+		dialed.Write(kp.public)
+		br := bufio.NewReader(dialed)
+		yb := make([]byte, keySize)
+		io.ReadFull(br, yb)
+		s, _ := kp.secret(yb)
+		enc, _ := newCipher("keyA", s, testKey)
+		req2 := hash([]byte("req2"), testKey[:])
+		req3 := hash([]byte("req3"), s)
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+		plain := append([]byte{}, vc...)
+		plain = binary.BigEndian.AppendUint32(plain, cryptoPlaintext)
+		plain = append(plain, 0, 0, 0, 0)
+		enc.XORKeyStream(plain, plain)
+		dialed.Write(append(append(hash([]byte("req1"), s), req2...), plain...))
+
+		err := <-received
+		if (err == nil) != (policy == Preferred) {
+			t.Errorf("%v: receiver returned %v", policy, err)
+		}
+	}
+}
+
+func TestReceiveUnknownTorrent(t *testing.T) {
+	dialed, accepted := tcpPair(t)
+	received := make(chan error, 1)
+	go func() {
+		_, err := Accept(accepted, [][20]byte{{1}, {2}}, Preferred)
+		accepted.Close()
+		received <- err
+	}()
+	Initiate(dialed, testKey, Required)
+	if <-received == nil {
+		t.Error("accepted a handshake for a torrent we don't have")
+	}
+}
@@ -0,0 +1,237 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// upload slots including the optimistic one when Torrent.UploadSlots is 0
+	defaultUploadSlots = 4
+	// how often the upload slots are handed out again
+	chokeInterval = 10 * time.Second
+	// the optimistic unchoke moves on every this many rounds, 30 seconds
+	optimisticRounds = 3
+	// a peer we want pieces from that hasn't sent a block for this long is
+	// snubbing us and loses its slot
+	snubTimeout = time.Minute
+	// peers connected more recently than this are this many times as likely
+	// to get the optimistic unchoke, they have nothing to offer yet
+	newPeerAge    = time.Minute
+	newPeerWeight = 3
+)
+
+// ChokeRound is the outcome of one re-evaluation of the upload slots
+type ChokeRound struct {
+	// peers unchoked for their rate, fastest first
+	Unchoked []*client.Client
+	// the peer unchoked regardless of its rate, nil when nobody is waiting
+	Optimistic *client.Client
+	// interested peers left choked
+	Choked []*client.Client
+	// peers that stopped sending us blocks, they only get the optimistic slot
+	Snubbed []*client.Client
+	// peers were ranked by how fast we upload to them rather than how fast
+	// they upload to us
+	Seeding bool
+}
+
+// what the choker measured about a peer, guarded by chokeMu
+type chokeState struct {
+	connected      time.Time
+	lastBlock      time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	downRate       float64
+	upRate         float64
+	snubbed        bool
+}
+
+func (t *Torrent) uploadSlots() int {
+	if t.UploadSlots > 0 {
+		return t.UploadSlots
+	}
+	return defaultUploadSlots
+}
+
+func (t *Torrent) isSeeding() bool {
+	select {
+	case <-t.complete:
+		return true
+	default:
+		return false
+	}
+}
+
+// re-evaluates the upload slots until the torrent stops
+func (t *Torrent) chokeLoop() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for round := 1; ; round++ {
+		select {
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+			t.rechoke(round%optimisticRounds == 0)
+		}
+	}
+}
+
+// unchokes the peers that upload to us fastest, or that we upload to fastest
+// once we are seeding, plus one optimistic unchoke that moves on every 30s
+func (t *Torrent) rechoke(rotateOptimistic bool) ChokeRound {
+	t.connsMu.Lock()
+	peers := make([]*client.Client, 0, len(t.conns))
+	states := make(map[*client.Client]*peerState, len(t.conns))
+	for c, state := range t.conns {
+		peers = append(peers, c)
+		states[c] = state
+	}
+	t.connsMu.Unlock()
+
+	t.chokeMu.Lock()
+	defer t.chokeMu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(t.lastChoke).Seconds()
+	t.lastChoke = now
+	round := ChokeRound{Seeding: t.isSeeding()}
+
+	var candidates []*client.Client
+	for _, c := range peers {
+		cs := &states[c].choke
+		downloaded, uploaded := c.Downloaded(), c.Uploaded()
+		if elapsed > 0 {
+			cs.downRate = float64(downloaded-cs.lastDownloaded) / elapsed
+			cs.upRate = float64(uploaded-cs.lastUploaded) / elapsed
+		}
+		if downloaded > cs.lastDownloaded {
+			cs.lastBlock = now
+		}
+		cs.lastDownloaded, cs.lastUploaded = downloaded, uploaded
+
+		// anti-snubbing, a peer we are interested in has to keep sending
+		cs.snubbed = !round.Seeding && c.Interested && now.Sub(cs.lastBlock) > snubTimeout
+		if cs.snubbed {
+			round.Snubbed = append(round.Snubbed, c)
+		}
+		if c.Interesting && !cs.snubbed {
+			candidates = append(candidates, c)
+		}
+	}
+
+	rate := func(c *client.Client) float64 {
+		if round.Seeding {
+			return states[c].choke.upRate
+		}
+		return states[c].choke.downRate
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+
+	regular := min(len(candidates), t.uploadSlots()-1)
+	round.Unchoked = candidates[:regular]
+	unchoke := make(map[*client.Client]bool, t.uploadSlots())
+	for _, c := range round.Unchoked {
+		unchoke[c] = true
+	}
+
+	// the optimistic unchoke stays with its peer between rotations as long
+	// as the peer is still connected, interested and not unchoked anyway
+	optimistic := t.optimistic
+	if optimistic != nil && (rotateOptimistic || states[optimistic] == nil || !optimistic.Interesting || unchoke[optimistic]) {
+		optimistic = nil
+	}
+	if optimistic == nil {
+		optimistic = pickOptimistic(peers, states, unchoke, now)
+	}
+	t.optimistic = optimistic
+	if optimistic != nil {
+		round.Optimistic = optimistic
+		unchoke[optimistic] = true
+	}
+
+	var changed []*client.Client
+	for _, c := range peers {
+		if c.Interesting && !unchoke[c] {
+			round.Choked = append(round.Choked, c)
+		}
+		if c.Choking == unchoke[c] {
+			states[c].setChoking(c, !unchoke[c])
+			changed = append(changed, c)
+		}
+	}
+	// a peer that stopped reading must not hold up the round or the lock
+	for _, c := range changed {
+		go t.sendControl(c, states[c])
+	}
+
+	if t.OnChoke != nil {
+		t.OnChoke(round)
+	}
+	return round
+}
+
+// picks a random interested peer without a slot, new peers are favored
+func pickOptimistic(peers []*client.Client, states map[*client.Client]*peerState, unchoke map[*client.Client]bool, now time.Time) *client.Client {
+	var pool []*client.Client
+	for _, c := range peers {
+		if !c.Interesting || unchoke[c] {
+			continue
+		}
+		weight := 1
+		if now.Sub(states[c].choke.connected) < newPeerAge {
+			weight = newPeerWeight
+		}
+		for i := 0; i < weight; i++ {
+			pool = append(pool, c)
+		}
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[rand.Intn(len(pool))]
+}
+
+// records whether the peer wants pieces from us, a peer that becomes
+// interested while a slot is free is unchoked right away instead of waiting
+// for the next round
+func (t *Torrent) setInterest(c *client.Client, interested bool) error {
+	state := t.peerState(c)
+	if state == nil {
+		return nil
+	}
+
+	t.chokeMu.Lock()
+	c.Interesting = interested
+	if !interested || !c.Choking {
+		t.chokeMu.Unlock()
+		return nil
+	}
+
+	t.connsMu.Lock()
+	unchoked := 0
+	for other := range t.conns {
+		if !other.Choking {
+			unchoked++
+		}
+	}
+	t.connsMu.Unlock()
+
+	if unchoked < t.uploadSlots() {
+		state.setChoking(c, false)
+	}
+	t.chokeMu.Unlock()
+	return t.sendControl(c, state)
+}
+
+// true while we refuse the peer's requests
+func (t *Torrent) isChoking(c *client.Client) bool {
+	t.chokeMu.Lock()
+	defer t.chokeMu.Unlock()
+	return c.Choking
+}
@@ -0,0 +1,262 @@
+package p2p
+
+import (
+	"gotorrent/bitfield"
+	"gotorrent/client"
+	"gotorrent/message"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a torrent with just the state the choker looks at
+func chokerTorrent(slots int) *Torrent {
+	return &Torrent{
+		UploadSlots: slots,
+		complete:    make(chan struct{}),
+		conns:       make(map[*client.Client]*peerState),
+	}
+}
+
+// a choked peer on the other end of a pipe, interesting when it wants
+// pieces from us. The returned conn is the peer's side
+func chokerPeer(t *testing.T, tor *Torrent, interesting bool) (*client.Client, net.Conn) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	go io.Copy(io.Discard, theirs)
+
+	c := &client.Client{Conn: ours, Choked: true, Choking: true, Interesting: interesting}
+	tor.conns[c] = &peerState{choke: chokeState{connected: time.Now().Add(-time.Hour)}}
+	return c, theirs
+}
+
+// has the peer send us a block of n bytes
+func receive(t *testing.T, c *client.Client, theirs net.Conn, n int) {
+	t.Helper()
+	msg := message.Message{ID: message.MsgPiece, Payload: make([]byte, 8+n)}
+	go theirs.Write(msg.Serialize())
+	_, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contains(peers []*client.Client, c *client.Client) bool {
+	for _, p := range peers {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChokerRanksByDownloadRate(t *testing.T) {
+	tor := chokerTorrent(4)
+	var rounds []ChokeRound
+	tor.OnChoke = func(round ChokeRound) { rounds = append(rounds, round) }
+
+	var peers []*client.Client
+	var conns []net.Conn
+	for i := 0; i < 6; i++ {
+		c, theirs := chokerPeer(t, tor, true)
+		peers = append(peers, c)
+		conns = append(conns, theirs)
+	}
+	// start measuring from here, then peer i sends i blocks
+	tor.rechoke(false)
+	for i, c := range peers {
+		for j := 0; j < i; j++ {
+			receive(t, c, conns[i], 1000)
+		}
+	}
+	round := tor.rechoke(false)
+
+	if len(rounds) != 2 {
+		t.Fatalf("OnChoke called %d times", len(rounds))
+	}
+	if round.Seeding {
+		t.Error("ranked as seeding while downloading")
+	}
+	want := []*client.Client{peers[5], peers[4], peers[3]}
+	for i, c := range want {
+		if i >= len(round.Unchoked) || round.Unchoked[i] != c {
+			t.Fatalf("regular slots went to the wrong peers")
+		}
+	}
+	if len(round.Unchoked) != 3 {
+		t.Errorf("%d regular slots, want 3 next to the optimistic one", len(round.Unchoked))
+	}
+	if round.Optimistic == nil || contains(round.Unchoked, round.Optimistic) {
+		t.Error("no optimistic unchoke among the slower peers")
+	}
+	if len(round.Choked) != 2 || contains(round.Choked, round.Optimistic) {
+		t.Errorf("%d peers left choked, want 2", len(round.Choked))
+	}
+	for _, c := range peers {
+		unchoked := contains(round.Unchoked, c) || c == round.Optimistic
+		if c.Choking == unchoked {
+			t.Errorf("peer choking %v although it was unchoked %v", c.Choking, unchoked)
+		}
+	}
+}
+
+func TestChokerRotatesOptimistic(t *testing.T) {
+	tor := chokerTorrent(2)
+	fast, theirs := chokerPeer(t, tor, true)
+	for i := 0; i < 5; i++ {
+		chokerPeer(t, tor, true)
+	}
+	tor.rechoke(false)
+	// the fast peer keeps sending so it holds on to the regular slot
+	rechoke := func(rotate bool) ChokeRound {
+		receive(t, fast, theirs, 1000)
+		round := tor.rechoke(rotate)
+		if len(round.Unchoked) != 1 || round.Unchoked[0] != fast {
+			t.Fatal("the fastest peer didn't get the regular slot")
+		}
+		return round
+	}
+
+	first := rechoke(false)
+	// the optimistic unchoke stays put between rotations
+	for i := 0; i < 5; i++ {
+		if round := rechoke(false); round.Optimistic != first.Optimistic {
+			t.Fatal("optimistic unchoke moved before its rotation")
+		}
+	}
+
+	seen := map[*client.Client]bool{}
+	for i := 0; i < 50; i++ {
+		round := rechoke(true)
+		if round.Optimistic == nil || round.Optimistic == fast {
+			t.Fatal("optimistic unchoke went to nobody or to a peer unchoked anyway")
+		}
+		seen[round.Optimistic] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("the optimistic unchoke never moved in 50 rotations")
+	}
+
+	// and moves on right away when its peer loses interest
+	optimistic := tor.optimistic
+	optimistic.Interesting = false
+	if round := rechoke(false); round.Optimistic == optimistic || !optimistic.Choking {
+		t.Error("optimistic unchoke stayed with a peer that isn't interested")
+	}
+}
+
+func TestChokerExcludesSnubbed(t *testing.T) {
+	tor := chokerTorrent(4)
+	snubber, snubberConn := chokerPeer(t, tor, true)
+	sender, senderConn := chokerPeer(t, tor, true)
+	snubber.Interested = true
+	sender.Interested = true
+
+	// the snubber sent plenty, but over a minute ago
+	receive(t, snubber, snubberConn, 100000)
+	tor.rechoke(false)
+	tor.conns[snubber].choke.lastBlock = time.Now().Add(-2 * snubTimeout)
+	receive(t, sender, senderConn, 1000)
+
+	round := tor.rechoke(false)
+	if len(round.Snubbed) != 1 || round.Snubbed[0] != snubber {
+		t.Fatalf("snubbed peers %v", round.Snubbed)
+	}
+	if len(round.Unchoked) != 1 || round.Unchoked[0] != sender {
+		t.Error("a snubbing peer kept a regular slot")
+	}
+	if round.Optimistic != snubber {
+		t.Error("the snubbing peer didn't get the optimistic slot that was free")
+	}
+
+	// a block clears it
+	receive(t, snubber, snubberConn, 1000)
+	round = tor.rechoke(false)
+	if len(round.Snubbed) != 0 || !contains(round.Unchoked, snubber) {
+		t.Error("peer stayed snubbed after sending a block")
+	}
+}
+
+func TestChokerSeedingRanksByUploadRate(t *testing.T) {
+	tor := chokerTorrent(3)
+	close(tor.complete)
+
+	var peers []*client.Client
+	for i := 0; i < 4; i++ {
+		c, theirs := chokerPeer(t, tor, true)
+		// we are done with them, none of them snub us
+		c.Interested = true
+		peers = append(peers, c)
+		// peers that gave us the most get the least from us
+		receive(t, c, theirs, 10000*(4-i))
+	}
+	tor.rechoke(false)
+	for i, c := range peers {
+		err := c.SendPiece(0, 0, make([]byte, 1000*(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	round := tor.rechoke(false)
+	if !round.Seeding {
+		t.Error("not ranked as seeding after the download completed")
+	}
+	if len(round.Snubbed) != 0 {
+		t.Error("peers were snubbed while seeding")
+	}
+	if len(round.Unchoked) != 2 || round.Unchoked[0] != peers[3] || round.Unchoked[1] != peers[2] {
+		t.Error("regular slots didn't go to the peers we upload to fastest")
+	}
+}
+
+func TestChokerSurvivesPeerThatStopsReading(t *testing.T) {
+	tor := chokerTorrent(4)
+	tor.Picker = NewRarestFirstPicker(8)
+	tor.have = bitfield.New(8)
+	tor.TF.PieceHashes = make([][20]byte, 8)
+
+	// nothing ever reads from this pipe, every write to it blocks
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	stuck := &client.Client{Conn: ours, Choked: true, Choking: true, Interesting: true, Bitfield: bitfield.New(8)}
+	tor.conns[stuck] = &peerState{}
+	other, _ := chokerPeer(t, tor, true)
+	other.Bitfield = bitfield.New(8)
+
+	done := make(chan ChokeRound, 1)
+	go func() { done <- tor.rechoke(false) }()
+	select {
+	case round := <-done:
+		if !contains(round.Unchoked, stuck) && round.Optimistic != stuck {
+			t.Error("the stuck peer was not unchoked")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rechoke blocked on a peer that doesn't read")
+	}
+
+	// the stuck peer now has an unchoke it can't take off the wire, the
+	// torrent keeps going for everyone else
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		tor.isChoking(other)
+		tor.peerHas(other, 3)
+		tor.updateInterest(other)
+		tor.rechoke(false)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("other peers stalled behind the stuck one")
+	}
+	if !other.Interested {
+		t.Error("not interested in a peer with a piece we lack")
+	}
+}
@@ -0,0 +1,158 @@
+package p2p
+
+import (
+	"fmt"
+	"gotorrent/torrentfile"
+	"time"
+)
+
+const (
+	// most peers connected at once when Torrent.MaxConns is 0, further peers
+	// wait in the candidate queue until a slot frees up
+	defaultMaxConns = 50
+	// most dials waiting on a handshake at once when Torrent.MaxHalfOpen is 0
+	defaultMaxHalfOpen = 8
+
+	// peers failing this many times in a row are banned
+	maxPeerRetries = 5
+)
+
+// a peer whose connection ended is dialed again after this, doubling with
+// every further failure
+var retryBackoff = 15 * time.Second
+
+func (t *Torrent) maxConns() int {
+	if t.MaxConns > 0 {
+		return t.MaxConns
+	}
+	return defaultMaxConns
+}
+
+func (t *Torrent) maxHalfOpen() int {
+	if t.MaxHalfOpen > 0 {
+		return t.MaxHalfOpen
+	}
+	return defaultMaxHalfOpen
+}
+
+// queues peers we haven't seen yet to be dialed, peers can keep arriving from
+// the trackers, the DHT and other peers long after the download started
+func (t *Torrent) addPeers(peers []torrentfile.Peer) {
+	connected := t.connectedAddrs()
+
+	t.peersMu.Lock()
+	for _, peer := range peers {
+		key := peer.String()
+		if t.known[key] || connected[key] || t.isBanned(peer) {
+			continue
+		}
+		t.known[key] = true
+		t.Peers = append(t.Peers, peer)
+		t.candidates = append(t.candidates, peer)
+	}
+	t.peersMu.Unlock()
+
+	t.dialCandidates()
+}
+
+// dials queued peers while there are free connection slots and fewer than
+// maxHalfOpen dials are waiting on a handshake
+func (t *Torrent) dialCandidates() {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+
+	select {
+	case <-t.stopped:
+		return
+	default:
+	}
+
+	for t.active < t.maxConns() && t.halfOpen < t.maxHalfOpen() && len(t.candidates) > 0 {
+		peer := t.candidates[0]
+		t.candidates = t.candidates[1:]
+		if t.isBanned(peer) {
+			continue
+		}
+		t.active++
+		t.halfOpen++
+
+		t.workers.Add(1)
+		go t.startDownload(peer)
+	}
+}
+
+// a dial finished its handshake or failed, letting the next one start
+func (t *Torrent) dialDone() {
+	t.peersMu.Lock()
+	t.halfOpen--
+	t.peersMu.Unlock()
+
+	t.dialCandidates()
+}
+
+// takes a connection slot for a peer that connected to us, false when all
+// slots are in use
+func (t *Torrent) takeSlot() bool {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.active >= t.maxConns() {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// frees the slot of a connection that ended and hands it to the next peer,
+// the trackers are asked for more once the queue runs dry
+func (t *Torrent) releaseSlot() {
+	t.peersMu.Lock()
+	t.active--
+	gone := t.active == 0 && len(t.candidates) == 0
+	dry := len(t.candidates) == 0
+	t.peersMu.Unlock()
+
+	if gone {
+		t.signalNoPeers()
+	}
+	if dry && !t.isSeeding() {
+		t.reannounce()
+	}
+	t.dialCandidates()
+}
+
+// dials a peer again once its backoff passed, delivered resets the backoff
+// of a peer that gave us blocks before its connection ended. Peers that keep
+// failing are banned
+func (t *Torrent) retryLater(peer torrentfile.Peer, delivered bool) {
+	key := peer.String()
+
+	t.peersMu.Lock()
+	if delivered {
+		t.failures[key] = 0
+	}
+	failures := t.failures[key]
+	t.failures[key] = failures + 1
+	if failures+1 >= maxPeerRetries {
+		t.banned[key] = true
+	}
+	t.peersMu.Unlock()
+
+	if failures+1 >= maxPeerRetries {
+		fmt.Printf("Banning peer %s after %d failed connections\n", key, failures+1)
+		return
+	}
+	time.AfterFunc(retryBackoff<<failures, func() {
+		if t.isSeeding() {
+			// seeds come to us, there is nothing left to fetch
+			return
+		}
+		if t.connectedAddrs()[key] {
+			return
+		}
+
+		t.peersMu.Lock()
+		t.candidates = append(t.candidates, peer)
+		t.peersMu.Unlock()
+		t.dialCandidates()
+	})
+}
@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/torrentfile"
+	"net"
+	"testing"
+	"time"
+)
+
+// a torrent whose only connection slot is taken, so retried peers wait in
+// the candidate queue instead of being dialed
+func fullTorrent() *Torrent {
+	return &Torrent{
+		MaxConns:  1,
+		active:    1,
+		complete:  make(chan struct{}),
+		stopped:   make(chan struct{}),
+		conns:     make(map[*client.Client]*peerState),
+		known:     make(map[string]bool),
+		failures:  make(map[string]int),
+		banned:    make(map[string]bool),
+		bannedIPs: make(map[string]bool),
+		peersGone: make(chan struct{}, 1),
+	}
+}
+
+// true when the peer waits in the candidate queue
+func queued(tor *Torrent, peer torrentfile.Peer) bool {
+	tor.peersMu.Lock()
+	defer tor.peersMu.Unlock()
+	for _, p := range tor.candidates {
+		if p.String() == peer.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// how long it took the peer to be queued again, 0 when it wasn't within limit
+func requeuedAfter(tor *Torrent, peer torrentfile.Peer, limit time.Duration) time.Duration {
+	start := time.Now()
+	for time.Since(start) < limit {
+		if queued(tor, peer) {
+			return time.Since(start)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return 0
+}
+
+func TestRetryBacksOff(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = 50 * time.Millisecond
+	defer func() { retryBackoff = backoff }()
+
+	tor := fullTorrent()
+	peer := torrentfile.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	for failure := 0; failure < 3; failure++ {
+		tor.retryLater(peer, false)
+		wait := retryBackoff << failure
+		after := requeuedAfter(tor, peer, 4*wait)
+		if after == 0 || after < wait-10*time.Millisecond {
+			t.Fatalf("failure %d: dialed again after %v, want %v", failure+1, after, wait)
+		}
+		tor.peersMu.Lock()
+		tor.candidates = nil
+		tor.peersMu.Unlock()
+	}
+
+	// a peer that delivered blocks starts over
+	tor.retryLater(peer, true)
+	if after := requeuedAfter(tor, peer, 4*retryBackoff); after == 0 || after > 2*retryBackoff {
+		t.Errorf("dialed again after %v, want the backoff reset to %v", after, retryBackoff)
+	}
+}
+
+func TestRetryBansAfterFailures(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Hour
+	defer func() { retryBackoff = backoff }()
+
+	tor := fullTorrent()
+	peer := torrentfile.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	other := torrentfile.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6882}
+	for i := 1; i < maxPeerRetries; i++ {
+		tor.retryLater(peer, false)
+		if tor.isBanned(peer) {
+			t.Fatalf("banned after %d failures", i)
+		}
+	}
+	// delivering blocks clears the failures
+	tor.retryLater(peer, true)
+	if tor.isBanned(peer) {
+		t.Fatal("banned although the peer delivered blocks")
+	}
+	for i := 1; i < maxPeerRetries; i++ {
+		tor.retryLater(peer, false)
+	}
+	if !tor.isBanned(peer) {
+		t.Fatalf("not banned after %d failures in a row", maxPeerRetries)
+	}
+	if tor.isBanned(other) {
+		t.Error("another port of the same ip was banned for failing")
+	}
+
+	// a banned peer handed to us again is not queued
+	tor.known = make(map[string]bool)
+	tor.addPeers([]torrentfile.Peer{peer, other})
+	if queued(tor, peer) || !queued(tor, other) {
+		t.Error("banned peer queued to be dialed")
+	}
+}
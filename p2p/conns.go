@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"bytes"
+	"gotorrent/bitfield"
+	"gotorrent/client"
+	"gotorrent/message"
+	"gotorrent/torrentfile"
+)
+
+// what the torrent keeps about a connected peer
+type peerState struct {
+	// exchanges peers with the peer, nil for private torrents
+	pex *pexPeer
+	// the peer had every piece when it connected
+	seed bool
+	// pieces we serve the peer even while choking it
+	allowedFast map[int]bool
+	choke       chokeState
+	// choke and interest messages decided under chokeMu and not sent yet,
+	// and whether a goroutine is sending them
+	control []*message.Message
+	sending bool
+}
+
+// sets whether we choke the peer and queues the message telling it, the
+// caller holds chokeMu and calls sendControl after letting go of it
+func (state *peerState) setChoking(c *client.Client, choking bool) {
+	c.Choking = choking
+	id := message.MsgUnchoke
+	if choking {
+		id = message.MsgChoke
+	}
+	state.control = append(state.control, &message.Message{ID: id})
+}
+
+// like setChoking for whether we are interested in the peer
+func (state *peerState) setInterested(c *client.Client, interested bool) {
+	c.Interested = interested
+	id := message.MsgNotInterested
+	if interested {
+		id = message.MsgInterested
+	}
+	state.control = append(state.control, &message.Message{ID: id})
+}
+
+// sends the queued choke and interest messages in the order they were
+// decided. Writes happen without chokeMu so a peer that stops reading only
+// holds up the goroutine sending to it, while another goroutine already
+// sending for the peer takes over the messages queued since
+func (t *Torrent) sendControl(c *client.Client, state *peerState) error {
+	t.chokeMu.Lock()
+	if state.sending {
+		t.chokeMu.Unlock()
+		return nil
+	}
+	state.sending = true
+	for len(state.control) > 0 {
+		msgs := state.control
+		state.control = nil
+		t.chokeMu.Unlock()
+
+		for _, msg := range msgs {
+			err := c.Send(msg)
+			if err != nil {
+				t.chokeMu.Lock()
+				state.sending = false
+				state.control = nil
+				t.chokeMu.Unlock()
+				return err
+			}
+		}
+		t.chokeMu.Lock()
+	}
+	state.sending = false
+	t.chokeMu.Unlock()
+	return nil
+}
+
+// registers a connection, false when it is a connection to ourselves, a
+// second connection to a peer or the torrent stopped. When both sides dial
+// each other at once the connection opened by the side with the higher peer
+// id is the one kept, so both agree on which to drop
+func (t *Torrent) addConn(c *client.Client, state *peerState) bool {
+	remote := c.RemotePeerID()
+	if remote == t.PeerID {
+		return false
+	}
+
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	// checked under connsMu so stopPeers sees every connection let in
+	select {
+	case <-t.stopped:
+		return false
+	default:
+	}
+
+	for other := range t.conns {
+		if other.RemotePeerID() != remote {
+			continue
+		}
+		weOpen := bytes.Compare(t.PeerID[:], remote[:]) > 0
+		if c.Outbound() != weOpen || other.Outbound() == weOpen {
+			return false
+		}
+		other.Conn.Close()
+		delete(t.conns, other)
+	}
+
+	t.conns[c] = state
+	t.running.Add(1)
+	return true
+}
+
+// called once the goroutine of a registered connection is done with it
+func (t *Torrent) removeConn(c *client.Client) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	delete(t.conns, c)
+	t.running.Done()
+}
+
+func isSeed(bf bitfield.Bitfield, numPieces int) bool {
+	for i := 0; i < numPieces; i++ {
+		if !bf.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Torrent) peerState(c *client.Client) *peerState {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	return t.conns[c]
+}
+
+// true when the piece is in the allowed fast set we gave the peer
+func (t *Torrent) allowedFast(c *client.Client, index int) bool {
+	state := t.peerState(c)
+	return state != nil && state.allowedFast[index]
+}
+
+// the address the peer accepts connections on, peers that connected to us
+// only tell us through the p field of their extended handshake
+func listenAddr(c *client.Client) (torrentfile.Peer, bool) {
+	if c.Outbound() {
+		return c.Peer(), true
+	}
+	hs := c.PeerExtensions()
+	if hs == nil || hs.P <= 0 || hs.P > 65535 {
+		return torrentfile.Peer{}, false
+	}
+	return torrentfile.Peer{IP: c.Peer().IP, Port: uint16(hs.P)}, true
+}
+
+// the listen addresses of every connected peer we know them for
+func (t *Torrent) connectedAddrs() map[string]bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+
+	addrs := make(map[string]bool, len(t.conns))
+	for c := range t.conns {
+		if addr, ok := listenAddr(c); ok {
+			addrs[addr.String()] = true
+		}
+	}
+	return addrs
+}
+
+// true when the peer has a piece we don't, the caller holds chokeMu
+func (t *Torrent) wantsFrom(c *client.Client) bool {
+	t.haveMu.RLock()
+	defer t.haveMu.RUnlock()
+	return t.have.Missing(c.Bitfield, len(t.TF.PieceHashes))
+}
+
+// tells the peer whether it has pieces we want, only when that changed
+func (t *Torrent) updateInterest(c *client.Client) error {
+	state := t.peerState(c)
+	if state == nil {
+		return nil
+	}
+
+	t.chokeMu.Lock()
+	wants := t.wantsFrom(c)
+	if wants != c.Interested {
+		state.setInterested(c, wants)
+	}
+	t.chokeMu.Unlock()
+	return t.sendControl(c, state)
+}
+
+// records a piece the peer announced, bitfields of registered peers are only
+// written under chokeMu so other goroutines may read them under it
+func (t *Torrent) peerHas(c *client.Client, index int) error {
+	state := t.peerState(c)
+	if state == nil {
+		return nil
+	}
+
+	t.chokeMu.Lock()
+	if c.Bitfield.HasPiece(index) {
+		t.chokeMu.Unlock()
+		return nil
+	}
+	c.Bitfield.SetPiece(index)
+	t.Picker.PeerHave(index)
+
+	if !c.Interested && !t.hasPiece(index) {
+		state.setInterested(c, true)
+	}
+	t.chokeMu.Unlock()
+	return t.sendControl(c, state)
+}
+
+// tells every connected peer about a piece we wrote and stops being
+// interested in peers that have nothing left for us
+func (t *Torrent) broadcastHave(index int) {
+	t.connsMu.Lock()
+	peers := make([]*client.Client, 0, len(t.conns))
+	for c := range t.conns {
+		peers = append(peers, c)
+	}
+	t.connsMu.Unlock()
+
+	for _, c := range peers {
+		// a failed write ends the peer's connection, its worker cleans up
+		if c.SendHave(index) != nil {
+			continue
+		}
+		t.updateInterest(c)
+	}
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"fmt"
+	"gotorrent/torrentfile"
+	"time"
+)
+
+const (
+	// how often the DHT is asked for more peers while the torrent runs
+	dhtInterval = 5 * time.Minute
+	// how often the trackers are asked for more peers while the torrent runs
+	trackerInterval = 30 * time.Minute
+	// trackers are not asked again sooner than this
+	minReannounceInterval = time.Minute
+)
+
+// asks the trackers for peers in the background, at most once a minute
+func (t *Torrent) reannounce() {
+	if len(t.TF.AnnounceList) == 0 {
+		// trackerless torrents only find peers through the DHT and pex
+		return
+	}
+
+	t.peersMu.Lock()
+	select {
+	case <-t.stopped:
+		t.peersMu.Unlock()
+		return
+	default:
+	}
+	if t.announcing || time.Since(t.lastAnnounce) < minReannounceInterval {
+		t.peersMu.Unlock()
+		return
+	}
+	t.announcing = true
+	t.lastAnnounce = time.Now()
+	t.peersMu.Unlock()
+
+	go func() {
+		defer func() {
+			t.peersMu.Lock()
+			t.announcing = false
+			t.peersMu.Unlock()
+		}()
+
+		peers, err := t.TF.AnnounceProgress(t.listenPort(), "", t.progress())
+		if err != nil {
+			fmt.Printf("Could not get fresh peers from the trackers: %v\n", err)
+			return
+		}
+		t.addPeers(peers)
+	}()
+}
+
+// what the trackers are told about the transfer, left counts the pieces we
+// don't have yet in full
+func (t *Torrent) progress() torrentfile.Progress {
+	have := t.haveBitfield()
+	left := 0
+	for i := range t.TF.PieceHashes {
+		if !have.HasPiece(i) {
+			left += t.calculatePieceSize(i)
+		}
+	}
+	return torrentfile.Progress{
+		Downloaded: int(t.downloaded.Load()),
+		Uploaded:   int(t.uploaded.Load()),
+		Left:       left,
+	}
+}
+
+// keeps the candidate queue fed from the trackers until the torrent stops
+func (t *Torrent) feedFromTrackers() {
+	ticker := time.NewTicker(trackerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+			t.reannounce()
+		}
+	}
+}
+
+// looks the torrent up in the DHT until it stops, announcing our listening
+// port so other peers can find us too
+func (t *Torrent) feedFromDHT() {
+	for {
+		peers, err := t.DHT.GetPeers(t.TF.InfoHash, t.listenPort())
+		if err == nil {
+			t.addPeers(peers)
+		}
+
+		select {
+		case <-t.stopped:
+			return
+		case <-time.After(dhtInterval):
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/message"
+	"time"
+)
+
+const (
+	// max blocksize allowed to be requested
+	blockSize = 16384
+	// a block request the peer hasn't answered after this is withdrawn so
+	// another peer can be asked, a peer that sent nothing at all in that
+	// time is dropped
+	blockTimeout = 30 * time.Second
+)
+
+// an outstanding request for a block
+type blockRequest struct {
+	sent time.Time
+	// what the peer had sent us when the request went out, to tell a slow
+	// peer from one that stopped sending
+	downloaded int64
+}
+
+// a piece being downloaded, shared by every peer working on it. Blocks are
+// the unit of work: any peer that has the piece may request the blocks
+// nobody has asked for yet, and a piece whose peers all left keeps the
+// blocks it got until another peer picks it up. In endgame blocks already
+// requested are handed out again and the first copy to arrive is kept
+type pieceDownload struct {
+	work      *pieceWork
+	buf       []byte
+	received  []bool
+	remaining int
+	// the ip of the peer each received block came from, to find out who
+	// sent corrupt data when the piece fails its hash check
+	from []string
+	// the peers with an outstanding request for each block
+	requested []map[*client.Client]blockRequest
+	// when each peer rejected a block or let its request time out, it
+	// isn't asked for the block again for a while or until it unchokes us
+	rejected []map[*client.Client]time.Time
+	// number of peers currently working on the piece
+	peers    int
+	finished bool
+}
+
+func (pd *pieceDownload) blockBounds(block int) (int, int) {
+	begin := block * blockSize
+	end := min(begin+blockSize, pd.work.length)
+	return begin, end - begin
+}
+
+// true when the peer may request the block, endgame allows blocks already
+// requested from other peers
+func (pd *pieceDownload) canRequest(block int, c *client.Client, endgame bool, now time.Time) bool {
+	if pd.received[block] {
+		return false
+	}
+	if _, ok := pd.requested[block][c]; ok {
+		return false
+	}
+	if at, ok := pd.rejected[block][c]; ok && now.Sub(at) < rejectRetryDelay {
+		return false
+	}
+	return endgame || len(pd.requested[block]) == 0
+}
+
+// joins the download of a piece, starting it if no peer is working on it yet
+func (t *Torrent) joinDownload(pw *pieceWork) *pieceDownload {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	pd, ok := t.downloads[pw.index]
+	if !ok {
+		numBlocks := (pw.length + blockSize - 1) / blockSize
+		pd = &pieceDownload{
+			work:      pw,
+			buf:       make([]byte, pw.length),
+			received:  make([]bool, numBlocks),
+			remaining: numBlocks,
+			from:      make([]string, numBlocks),
+			requested: make([]map[*client.Client]blockRequest, numBlocks),
+			rejected:  make([]map[*client.Client]time.Time, numBlocks),
+		}
+		t.downloads[pw.index] = pd
+	}
+	pd.peers++
+	return pd
+}
+
+// joins a piece already being downloaded that has blocks the peer can
+// request, the piece closest to completion first so partial pieces get
+// finished before new ones are started
+func (t *Torrent) joinPartial(c *client.Client, peer func(index int) bool) (*pieceDownload, bool) {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	now := time.Now()
+	var best *pieceDownload
+	for index, pd := range t.downloads {
+		if pd.finished || !peer(index) {
+			continue
+		}
+		if best != nil && pd.remaining >= best.remaining {
+			continue
+		}
+		for block := range pd.received {
+			if pd.canRequest(block, c, false, now) {
+				best = pd
+				break
+			}
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	best.peers++
+	return best, true
+}
+
+// takes back a join of a piece the peer was already working on
+func (t *Torrent) undoJoin(pd *pieceDownload) {
+	t.downloadsMu.Lock()
+	pd.peers--
+	t.downloadsMu.Unlock()
+}
+
+// leaves the download of a piece, withdrawing the peer's requests. When the
+// last peer leaves a piece without any block it is given back to the picker,
+// pieces with blocks stay reserved until another peer joins them
+func (t *Torrent) leaveDownload(pd *pieceDownload, c *client.Client) {
+	t.downloadsMu.Lock()
+
+	var cancels []int
+	if !pd.finished {
+		for block, requesters := range pd.requested {
+			if _, ok := requesters[c]; ok {
+				delete(requesters, c)
+				cancels = append(cancels, block)
+			}
+		}
+	}
+
+	pd.peers--
+	abort := pd.peers == 0 && !pd.finished && pd.remaining == len(pd.received)
+	if abort {
+		delete(t.downloads, pd.work.index)
+	}
+	t.downloadsMu.Unlock()
+
+	for _, block := range cancels {
+		begin, length := pd.blockBounds(block)
+		c.SendCancel(pd.work.index, begin, length)
+	}
+
+	if abort {
+		t.abortPiece(pd.work.index)
+	} else if len(cancels) > 0 {
+		// the blocks are free for other peers again
+		t.signalWork()
+	}
+}
+
+// the next block the peer should request, in endgame blocks already requested
+// from other peers are handed out again
+func (t *Torrent) nextBlock(pd *pieceDownload, c *client.Client, endgame bool) (int, int, bool) {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	if pd.finished {
+		return 0, 0, false
+	}
+	now := time.Now()
+	for block := range pd.received {
+		if !pd.canRequest(block, c, endgame, now) {
+			continue
+		}
+
+		if pd.requested[block] == nil {
+			pd.requested[block] = make(map[*client.Client]blockRequest)
+		}
+		pd.requested[block][c] = blockRequest{sent: now, downloaded: c.Downloaded()}
+
+		begin, length := pd.blockBounds(block)
+		return begin, length, true
+	}
+	return 0, 0, false
+}
+
+// true while the peer has a request outstanding on the piece
+func (t *Torrent) requestedFrom(pd *pieceDownload, c *client.Client) bool {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	for _, requesters := range pd.requested {
+		if _, ok := requesters[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withdraws the peer's requests on the piece that are older than
+// blockTimeout, stalled is true when the peer sent us nothing since the
+// oldest of them went out
+func (t *Torrent) expireRequests(pd *pieceDownload, c *client.Client) (stalled bool) {
+	t.downloadsMu.Lock()
+
+	if pd.finished {
+		t.downloadsMu.Unlock()
+		return false
+	}
+	now := time.Now()
+	var expired []int
+	for block, requesters := range pd.requested {
+		req, ok := requesters[c]
+		if !ok || now.Sub(req.sent) < blockTimeout {
+			continue
+		}
+		if c.Downloaded() == req.downloaded {
+			stalled = true
+		}
+		delete(requesters, c)
+		if pd.rejected[block] == nil {
+			pd.rejected[block] = make(map[*client.Client]time.Time)
+		}
+		pd.rejected[block][c] = now
+		expired = append(expired, block)
+	}
+	t.downloadsMu.Unlock()
+
+	for _, block := range expired {
+		begin, length := pd.blockBounds(block)
+		c.SendCancel(pd.work.index, begin, length)
+	}
+	if len(expired) > 0 {
+		t.signalWork()
+	}
+	return stalled
+}
+
+// stores a block received from a peer into the piece it belongs to and
+// cancels the same request at every other peer. Blocks for pieces nobody is
+// downloading anymore are dropped. Returns the piece when this block
+// completed it
+func (t *Torrent) receiveBlock(c *client.Client, msg *message.Message) (*pieceDownload, error) {
+	b, data, err := msg.ParseBlock(msg)
+	if err != nil {
+		return nil, err
+	}
+	c.BlockReceived(b.Index, b.Begin, b.Length)
+	t.downloaded.Add(int64(len(data)))
+
+	t.downloadsMu.Lock()
+
+	pd, ok := t.downloads[b.Index]
+	if !ok || pd.finished || b.Begin%blockSize != 0 || b.Begin >= pd.work.length {
+		t.downloadsMu.Unlock()
+		return nil, nil
+	}
+	block := b.Begin / blockSize
+	begin, length := pd.blockBounds(block)
+	if length != b.Length || pd.received[block] {
+		t.downloadsMu.Unlock()
+		return nil, nil
+	}
+
+	copy(pd.buf[begin:], data)
+	pd.received[block] = true
+	pd.from[block] = peerIP(c)
+	pd.remaining--
+
+	var others []*client.Client
+	for other := range pd.requested[block] {
+		if other != c {
+			others = append(others, other)
+		}
+	}
+	pd.requested[block] = nil
+
+	// the piece stays in downloads until it is verified, so it can't be
+	// picked and started over in the meantime
+	complete := pd.remaining == 0
+	if complete {
+		pd.finished = true
+	}
+	t.downloadsMu.Unlock()
+
+	for _, other := range others {
+		other.SendCancel(b.Index, begin, length)
+	}
+	if len(others) > 0 {
+		// the peers we canceled have room for other blocks
+		t.signalWork()
+	}
+
+	if complete {
+		return pd, nil
+	}
+	return nil, nil
+}
+
+// forgets the blocks of a checked piece. A verified piece stays behind
+// finished so peers still holding its index never start it over, a piece
+// failing the check is removed to be downloaded again
+func (t *Torrent) dropDownload(pd *pieceDownload, valid bool) {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	if !valid {
+		delete(t.downloads, pd.work.index)
+		return
+	}
+	pd.buf = nil
+	pd.received = nil
+	pd.from = nil
+	pd.requested = nil
+	pd.rejected = nil
+}
@@ -0,0 +1,169 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gotorrent/client"
+	"gotorrent/message"
+	"net"
+	"testing"
+	"time"
+)
+
+// a peer on the other end of a pipe, every message we send it shows up on
+// the returned channel
+func endgamePeer(t *testing.T) (*client.Client, chan *message.Message) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	msgs := make(chan *message.Message, 100)
+	go func() {
+		for {
+			msg, err := message.Read(theirs)
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return &client.Client{Conn: ours}, msgs
+}
+
+// the cancels among the messages the peer got so far
+func cancels(msgs chan *message.Message) []message.Block {
+	var blocks []message.Block
+	for {
+		select {
+		case msg := <-msgs:
+			if msg != nil && msg.ID == message.MsgCancel {
+				blocks = append(blocks, message.Block{
+					Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+					Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+					Length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+				})
+			}
+		case <-time.After(50 * time.Millisecond):
+			return blocks
+		}
+	}
+}
+
+// a torrent downloading a piece of two blocks
+func endgameTorrent() (*Torrent, *pieceDownload) {
+	tor := &Torrent{downloads: make(map[int]*pieceDownload), workSignal: make(chan struct{})}
+	pd := tor.joinDownload(&pieceWork{index: 2, length: 2 * blockSize})
+	return tor, pd
+}
+
+// has the peer request the block from us and records the request
+func request(t *testing.T, tor *Torrent, pd *pieceDownload, c *client.Client, block int, sent time.Time) {
+	t.Helper()
+	begin, length := pd.blockBounds(block)
+	err := c.SendRequest(pd.work.index, begin, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.downloadsMu.Lock()
+	defer tor.downloadsMu.Unlock()
+	if pd.requested[block] == nil {
+		pd.requested[block] = make(map[*client.Client]blockRequest)
+	}
+	pd.requested[block][c] = blockRequest{sent: sent, downloaded: c.Downloaded()}
+}
+
+func pieceMsg(index, begin int, data []byte) *message.Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &message.Message{ID: message.MsgPiece, Payload: payload}
+}
+
+func TestReceiveBlockCancelsOtherPeers(t *testing.T) {
+	tor, pd := endgameTorrent()
+	first, firstMsgs := endgamePeer(t)
+	second, secondMsgs := endgamePeer(t)
+	third, thirdMsgs := endgamePeer(t)
+
+	// in endgame the same block was asked from two peers
+	request(t, tor, pd, first, 0, time.Now())
+	request(t, tor, pd, second, 0, time.Now())
+	request(t, tor, pd, third, 1, time.Now())
+	block := bytes.Repeat([]byte{1}, blockSize)
+	done, err := tor.receiveBlock(first, pieceMsg(2, 0, block))
+	if err != nil || done != nil {
+		t.Fatalf("got %v, %v for the first of two blocks", done, err)
+	}
+
+	want := message.Block{Index: 2, Begin: 0, Length: blockSize}
+	if got := cancels(secondMsgs); len(got) != 1 || got[0] != want {
+		t.Errorf("other peer got cancels %v, want %v", got, want)
+	}
+	if got := cancels(firstMsgs); len(got) != 0 {
+		t.Errorf("the sending peer got cancels %v", got)
+	}
+	if got := cancels(thirdMsgs); len(got) != 0 {
+		t.Errorf("a peer asked for another block got cancels %v", got)
+	}
+
+	// the copy arriving late from the other peer is dropped
+	done, err = tor.receiveBlock(second, pieceMsg(2, 0, bytes.Repeat([]byte{2}, blockSize)))
+	if err != nil || done != nil || !bytes.Equal(pd.buf[:blockSize], block) {
+		t.Error("a duplicate block replaced the one received first")
+	}
+
+	// the last block completes the piece
+	done, err = tor.receiveBlock(third, pieceMsg(2, blockSize, block))
+	if err != nil || done != pd || !pd.finished {
+		t.Errorf("got %v, %v for the last block", done, err)
+	}
+	if got := cancels(firstMsgs); len(got) != 0 {
+		t.Errorf("cancels %v sent for a block nobody else requested", got)
+	}
+}
+
+func TestExpireRequests(t *testing.T) {
+	tor, pd := endgameTorrent()
+	c, msgs := endgamePeer(t)
+	other, otherMsgs := endgamePeer(t)
+
+	request(t, tor, pd, c, 0, time.Now().Add(-2*blockTimeout))
+	request(t, tor, pd, c, 1, time.Now())
+	request(t, tor, pd, other, 0, time.Now())
+
+	if !tor.expireRequests(pd, c) {
+		t.Error("a peer that sent nothing since its request was not reported stalled")
+	}
+	want := message.Block{Index: 2, Begin: 0, Length: blockSize}
+	if got := cancels(msgs); len(got) != 1 || got[0] != want {
+		t.Errorf("got cancels %v, want only the expired request %v", got, want)
+	}
+	if got := cancels(otherMsgs); len(got) != 0 {
+		t.Errorf("the other peer's request was canceled %v", got)
+	}
+
+	tor.downloadsMu.Lock()
+	_, requested := pd.requested[0][c]
+	_, otherRequested := pd.requested[0][other]
+	_, stillRequested := pd.requested[1][c]
+	_, rejected := pd.rejected[0][c]
+	tor.downloadsMu.Unlock()
+	if requested || !otherRequested || !stillRequested {
+		t.Error("withdrew the wrong requests")
+	}
+	// and it isn't asked for the block again right away
+	if !rejected || pd.canRequest(0, c, true, time.Now()) {
+		t.Error("the peer may be asked for the expired block again at once")
+	}
+
+	// a slow peer that still sends is not stalled
+	tor.downloadsMu.Lock()
+	pd.requested[1][c] = blockRequest{sent: time.Now().Add(-2 * blockTimeout), downloaded: c.Downloaded() - 1}
+	tor.downloadsMu.Unlock()
+	if tor.expireRequests(pd, c) {
+		t.Error("a peer that sent data since its request was reported stalled")
+	}
+}
@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/handshake"
+	"gotorrent/message"
+	"gotorrent/metadata"
+	"gotorrent/pex"
+)
+
+// how many block requests we queue for a peer, sent as reqq
+const maxQueuedRequests = 250
+
+// registers the extensions the torrent speaks on a peer and sends our extended
+// handshake, peers without the extension protocol are left alone
+func (t *Torrent) startExtensions(c *client.Client, state *peerState) error {
+	if !c.Supports(handshake.ExtensionProtocol) {
+		return nil
+	}
+
+	if state.pex != nil {
+		c.RegisterExtension(pex.ExtensionName, state.pex)
+	}
+
+	if len(t.TF.InfoBytes) > 0 {
+		c.RegisterExtension(metadata.ExtensionName, metadata.NewServer(t.TF.InfoBytes))
+	}
+
+	hs := message.ExtendedHandshake{
+		Reqq:         maxQueuedRequests,
+		MetadataSize: len(t.TF.InfoBytes),
+	}
+	if t.Listener != nil {
+		hs.P = int(t.Listener.Port)
+	}
+	return c.SendExtendedHandshake(hs)
+}
@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"gotorrent/client"
+	"gotorrent/message"
+	"net"
+	"time"
+)
+
+const (
+	// pieces in the allowed fast set we give each peer
+	allowedFastCount = 10
+	// a peer that rejected a block while unchoking us, for instance because
+	// its request queue was full, is asked for it again after this
+	rejectRetryDelay = 2 * time.Second
+)
+
+// the canonical allowed fast set of a peer (BEP 6), derived from its address
+// so reconnecting doesn't get a peer a different set. Only defined for ipv4
+func allowedFastSet(ip net.IP, infohash [20]byte, numPieces int) map[int]bool {
+	set := make(map[int]bool)
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return set
+	}
+	k := min(allowedFastCount, numPieces)
+
+	x := make([]byte, 0, 24)
+	x = binary.BigEndian.AppendUint32(x, binary.BigEndian.Uint32(ip4)&0xFFFFFF00)
+	x = append(x, infohash[:]...)
+
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			set[int(y%uint32(numPieces))] = true
+		}
+	}
+	return set
+}
+
+// gives a block the peer won't send back so it can be requested again right
+// away, from other peers or from this one once it unchokes us again
+func (t *Torrent) requeueBlock(c *client.Client, b message.Block, rejected bool) {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+
+	pd, ok := t.downloads[b.Index]
+	if !ok || pd.finished || b.Begin%blockSize != 0 || b.Begin >= pd.work.length {
+		return
+	}
+	block := b.Begin / blockSize
+	delete(pd.requested[block], c)
+	if rejected {
+		if pd.rejected[block] == nil {
+			pd.rejected[block] = make(map[*client.Client]time.Time)
+		}
+		pd.rejected[block][c] = time.Now()
+	}
+}
+
+// the peer rejected one of our requests
+func (t *Torrent) handleReject(c *client.Client, msg *message.Message) error {
+	index, begin, length, err := msg.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if c.BlockReceived(index, begin, length) {
+		t.requeueBlock(c, message.Block{Index: index, Begin: begin, Length: length}, true)
+		t.signalWork()
+	}
+	return nil
+}
+
+// peers without the fast extension silently drop our requests when they
+// choke us, so every outstanding request goes back to be requested again
+func (t *Torrent) requeueAll(c *client.Client) {
+	dropped := c.DropRequests()
+	for _, b := range dropped {
+		t.requeueBlock(c, b, false)
+	}
+	if len(dropped) > 0 {
+		t.signalWork()
+	}
+}
+
+// an unchoke means the peer may serve blocks it rejected before
+func (t *Torrent) clearRejects(c *client.Client) {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+	for _, pd := range t.downloads {
+		for _, rejecters := range pd.rejected {
+			delete(rejecters, c)
+		}
+	}
+}
+
+// true when the peer rejected a block we still need within rejectRetryDelay
+func (t *Torrent) rejectedAny(c *client.Client) bool {
+	t.downloadsMu.Lock()
+	defer t.downloadsMu.Unlock()
+	for _, pd := range t.downloads {
+		for block, rejecters := range pd.rejected {
+			if at, ok := rejecters[c]; ok && !pd.received[block] && time.Since(at) < rejectRetryDelay {
+				return true
+			}
+		}
+	}
+	return false
+}
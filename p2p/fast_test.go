@@ -0,0 +1,41 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infohash [20]byte
+	copy(infohash[:], bytes.Repeat([]byte{0xaa}, 20))
+
+	// the example of BEP 6, which lists the first 9 pieces of the set for a
+	// torrent of 1313 pieces
+	want := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	set := allowedFastSet(net.IPv4(80, 4, 4, 200), infohash, 1313)
+	if len(set) != allowedFastCount {
+		t.Errorf("%d pieces in the set, want %d", len(set), allowedFastCount)
+	}
+	for _, index := range want {
+		if !set[index] {
+			t.Errorf("piece %d of the reference set missing from %v", index, set)
+		}
+	}
+
+	// peers of the same /24 share the set
+	other := allowedFastSet(net.IPv4(80, 4, 4, 1), infohash, 1313)
+	for index := range set {
+		if !other[index] {
+			t.Errorf("a peer in the same /24 got a different set %v", other)
+			break
+		}
+	}
+
+	if set := allowedFastSet(net.IPv4(80, 4, 4, 200), infohash, 4); len(set) != 4 {
+		t.Errorf("got %v for a torrent of 4 pieces, want every piece", set)
+	}
+	if set := allowedFastSet(net.ParseIP("2001:db8::1"), infohash, 1313); len(set) != 0 {
+		t.Errorf("got %v for an ipv6 peer", set)
+	}
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"fmt"
+	"gotorrent/client"
+	"gotorrent/handshake"
+	"gotorrent/mse"
+	"gotorrent/utp"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Listener accepts incoming peer connections and hands them to the torrent
+// whose infohash the peer asked for
+type Listener struct {
+	Port uint16
+	// uTP connections arrive on the same port over UDP, other UDP packets
+	// such as the DHT's are read from the socket too
+	UTP *utp.Socket
+
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	port = uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	socket, err := utp.Listen(port)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return &Listener{
+		Port:     port,
+		UTP:      socket,
+		ln:       ln,
+		torrents: make(map[[20]byte]*Torrent),
+	}, nil
+}
+
+// starts accepting connections for the torrent
+func (l *Listener) Add(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.TF.InfoHash] = t
+}
+
+func (l *Listener) Remove(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, t.TF.InfoHash)
+}
+
+func (l *Listener) lookup(infohash [20]byte) *Torrent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infohash]
+}
+
+// the infohashes an encrypted connection may ask for
+func (l *Listener) infohashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hashes := make([][20]byte, 0, len(l.torrents))
+	for infohash := range l.torrents {
+		hashes = append(hashes, infohash)
+	}
+	return hashes
+}
+
+// accepts TCP and uTP connections until the listener is closed
+func (l *Listener) Serve() error {
+	errs := make(chan error, 2)
+	for _, ln := range []net.Listener{l.ln, l.UTP} {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go l.handle(conn)
+			}
+		}(ln)
+	}
+	err := <-errs
+	l.Close()
+	<-errs
+	return err
+}
+
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.UTP.Close()
+	return err
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// peers may open with the encryption handshake, which leaves a connection
+	// that decrypts their BitTorrent handshake
+	raw := conn
+	conn, err := mse.Accept(raw, l.infohashes(), client.Encryption)
+	if err != nil {
+		raw.Close()
+		return
+	}
+
+	hs, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	t := l.lookup(hs.InfoHash)
+	if t == nil {
+		fmt.Printf("Peer %s asked for unknown infohash %x, disconnecting\n", conn.RemoteAddr(), hs.InfoHash)
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, hs, t.PeerID, t.haveBitfield(), len(t.TF.PieceHashes))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.acceptPeer(c)
+}
+
+// runs an incoming peer through the same worker as the peers we dialed
+func (t *Torrent) acceptPeer(c *client.Client) {
+	t.peersMu.Lock()
+	banned := t.bannedIPs[peerIP(c)]
+	t.peersMu.Unlock()
+	if banned || !t.takeSlot() {
+		c.Conn.Close()
+		return
+	}
+
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		defer t.releaseSlot()
+		t.runPeer(c)
+	}()
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"gotorrent/bitfield"
 	"gotorrent/cli"
 	"gotorrent/client"
+	"gotorrent/dht"
 	"gotorrent/file"
-	"gotorrent/message"
+	"gotorrent/handshake"
+	"gotorrent/ratelimit"
 	"gotorrent/torrentfile"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,15 +21,81 @@ type Torrent struct {
 	Peers  []torrentfile.Peer
 	PeerID [20]byte
 	TF     torrentfile.TorrentFile
-}
-
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	// keep serving pieces to peers once the download has completed
+	Seed bool
+	// accepts incoming connections for the torrent while it downloads
+	Listener *Listener
+	// chooses which piece to download next, rarest first when left nil
+	Picker PiecePicker
+	// finds more peers while the torrent runs, the DHT isn't used when nil
+	DHT *dht.DHT
+	// peers unchoked at once including the optimistic unchoke, 4 when 0
+	UploadSlots int
+	// called after every choke round with the decisions made
+	OnChoke func(ChokeRound)
+	// the download fails when no piece arrived for this long, 10 minutes
+	// when 0
+	StallTimeout time.Duration
+	// most peers connected at once, 50 when 0
+	MaxConns int
+	// most outgoing connections waiting on their handshake at once, 8 when 0
+	MaxHalfOpen int
+	// bytes per second received from and sent to the torrent's peers on top
+	// of client.DownloadLimit and client.UploadLimit. Unlimited ones are
+	// created when nil, their rate can be changed while the torrent runs
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	file       *file.File
+	prQueue    chan *pieceResult
+	complete   chan struct{}
+	workSignal chan struct{}
+	signalMu   sync.Mutex
+	// pieces being downloaded, keyed by piece index
+	downloads   map[int]*pieceDownload
+	downloadsMu sync.Mutex
+	have        bitfield.Bitfield
+	haveMu      sync.RWMutex
+	workers     sync.WaitGroup
+	// addresses of every peer we dialed or queued to dial
+	known map[string]bool
+	// peers waiting for a free connection slot
+	candidates []torrentfile.Peer
+	// connection slots in use and dials among them still handshaking
+	active   int
+	halfOpen int
+	// connections in a row that ended for each peer address and the peers
+	// that failed too often to be dialed again
+	failures map[string]int
+	banned   map[string]bool
+	// ips of peers that sent corrupt data, banned for the session
+	bannedIPs map[string]bool
+	// piece data received and sent this session, reported to the trackers
+	downloaded   atomic.Int64
+	uploaded     atomic.Int64
+	announcing   bool
+	lastAnnounce time.Time
+	peersMu      sync.Mutex
+	// signalled when the last peer went away
+	peersGone chan struct{}
+	conns     map[*client.Client]*peerState
+	connsMu   sync.Mutex
+	// goroutines of registered connections, they may still read from the
+	// file until they are done
+	running sync.WaitGroup
+	// closed once DownloadTorrent returns
+	stopped chan struct{}
+	// guards the choke and interest state of every peer and writes to the
+	// bitfields of registered peers
+	chokeMu    sync.Mutex
+	optimistic *client.Client
+	lastChoke  time.Time
+	// blocks of failed pieces by piece index, until a copy passes
+	suspects map[int][]blockRecord
+	banMu    sync.Mutex
+	// closed by Stop
+	quit   chan struct{}
+	quitMu sync.Mutex
 }
 
 type pieceWork struct {
@@ -38,37 +109,6 @@ type pieceResult struct {
 	buf   []byte
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := message.Read(state.client.Conn)
-	if err != nil {
-		return err
-	}
-	if msg == nil {
-		return nil
-	}
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := msg.ParseHavePiece(msg)
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := msg.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
-	}
-
-	return nil
-}
-
 func validatePiece(pieceHash [20]byte, buf []byte) (bool, error) {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(pieceHash[:], hash[:]) {
@@ -77,52 +117,163 @@ func validatePiece(pieceHash [20]byte, buf []byte) (bool, error) {
 	return true, nil
 }
 
-func downloadPiece(c *client.Client, pw *pieceWork) (*pieceResult, error) {
+// a piece the peer goroutine requests blocks of
+type activePiece struct {
+	pd      *pieceDownload
+	endgame bool
+}
+
+// requests blocks from the peer until there is nothing left to download and
+// then keeps serving it. The queue of outstanding requests is sized by the
+// peer's pipeline and may span several pieces, so it doesn't drain every
+// time a piece runs out of blocks to request
+func (t *Torrent) download(p *peerConn) error {
+	c := p.client
+	pl := newPipeline()
 
-	state := pieceProgress{
-		index:      pw.index,
-		client:     c,
-		buf:        make([]byte, pw.length),
-		downloaded: 0,
-		requested:  0,
-		backlog:    0,
-	}
+	var pieces []activePiece
+	defer func() {
+		for _, piece := range pieces {
+			t.leaveDownload(piece.pd, c)
+		}
+	}()
 
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+	ticker := time.NewTicker(blockTimeout / 4)
+	defer ticker.Stop()
 
-	for state.downloaded < pw.length {
+	for {
+		pl.update(c, time.Now())
 
-		if !state.client.Choked {
-			blocksize := 16384 // max blocksize allowed to be requested
-			for state.backlog < 5 && state.requested < pw.length {
-				if pw.length-state.requested < blocksize {
-					blocksize = pw.length - state.requested
-				}
-				// start asking for blocks
-				err := c.SendRequest(pw.index, state.requested, blocksize)
-				if err != nil {
-					return nil, err
+		var err error
+		pieces, err = t.fillRequests(c, pieces, pl.size(peerQueue(c)))
+		if err != nil {
+			return err
+		}
+
+		if c.PendingRequests() == 0 {
+			pl.idle()
+			if t.isSeeding() {
+				// the download is done but the peer may still want pieces from us
+				return t.serve(p)
+			}
+			err := t.waitForWork(p)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		signal := t.currentWorkSignal()
+		select {
+		case msg, ok := <-p.msgs:
+			if !ok {
+				return p.err
+			}
+			if msg == nil {
+				continue
+			}
+			err := t.handleMessage(c, msg)
+			if err != nil {
+				return err
+			}
+		case <-signal:
+			// other peers gave blocks back or took ours in endgame
+		case <-ticker.C:
+			for _, piece := range pieces {
+				if t.expireRequests(piece.pd, c) {
+					return fmt.Errorf("Peer %s sent no block for %v", c.Conn.RemoteAddr(), blockTimeout)
 				}
-				state.backlog++
-				state.requested += blocksize
 			}
 		}
+	}
+}
 
-		err := state.readMessage()
+// sends requests until depth are outstanding, from the pieces the peer is
+// already on first and then from newly picked ones. Pieces the peer has
+// nothing left to request of and no request outstanding on are left
+func (t *Torrent) fillRequests(c *client.Client, pieces []activePiece, depth int) ([]activePiece, error) {
+	if t.isQuitting() {
+		return pieces, nil
+	}
+	exhausted := make(map[*pieceDownload]bool)
+
+	for i := 0; c.PendingRequests() < depth; {
+		if i == len(pieces) {
+			pd, endgame, ok := t.pickDownload(c)
+			if !ok {
+				break
+			}
+			if onPiece(pieces, pd) {
+				// endgame handed out a piece we already request all we can of
+				t.undoJoin(pd)
+				break
+			}
+			pieces = append(pieces, activePiece{pd: pd, endgame: endgame})
+		}
 
+		piece := pieces[i]
+		// the allowed fast set may be requested even while choked
+		if c.Choked && !c.AllowedFast[piece.pd.work.index] {
+			exhausted[piece.pd] = true
+			i++
+			continue
+		}
+		begin, length, ok := t.nextBlock(piece.pd, c, piece.endgame)
+		if !ok {
+			exhausted[piece.pd] = true
+			i++
+			continue
+		}
+		err := c.SendRequest(piece.pd.work.index, begin, length)
 		if err != nil {
-			return nil, err
+			return pieces, err
 		}
 	}
 
-	return &pieceResult{
-		index: pw.index,
-		buf:   state.buf,
-	}, nil
+	kept := pieces[:0]
+	for _, piece := range pieces {
+		if exhausted[piece.pd] && !t.requestedFrom(piece.pd, c) {
+			t.leaveDownload(piece.pd, c)
+			continue
+		}
+		kept = append(kept, piece)
+	}
+	return kept, nil
 }
 
-func (t Torrent) calcPieceBounds(index int) (begin, end int) {
+func onPiece(pieces []activePiece, pd *pieceDownload) bool {
+	for _, piece := range pieces {
+		if piece.pd == pd {
+			return true
+		}
+	}
+	return false
+}
+
+// verifies a completed piece and queues it to be written, a piece failing
+// the hash check is given back to be downloaded again and the peers that
+// sent it are held responsible, not the peer that happened to complete it
+func (t *Torrent) finishPiece(c *client.Client, pd *pieceDownload) error {
+	valid, err := validatePiece(pd.work.hash, pd.buf)
+	if !valid {
+		fmt.Printf("Discarding piece %d: %v\n", pd.work.index, err)
+		t.pieceFailed(pd)
+		t.dropDownload(pd, false)
+		t.abortPiece(pd.work.index)
+		return nil
+	}
+	t.pieceVerified(pd)
+	t.Picker.Done(pd.work.index)
+
+	t.prQueue <- &pieceResult{
+		index: pd.work.index,
+		buf:   pd.buf,
+	}
+	t.dropDownload(pd, true)
+	return nil
+}
+
+func (t *Torrent) calcPieceBounds(index int) (begin, end int) {
 	begin = index * t.TF.PieceLength
 	end = begin + t.TF.PieceLength
 
@@ -133,61 +284,209 @@ func (t Torrent) calcPieceBounds(index int) (begin, end int) {
 	return begin, end
 }
 
-func (t Torrent) calculatePieceSize(index int) int {
+func (t *Torrent) calculatePieceSize(index int) int {
 	begin, end := t.calcPieceBounds(index)
 	return end - begin
 }
 
-func (t Torrent) startDownload(peer torrentfile.Peer, pwQueue chan *pieceWork, prQueue chan *pieceResult) error {
-	client, err := client.New(peer, t.PeerID, t.TF.InfoHash)
+func (t *Torrent) pieceWork(index int) *pieceWork {
+	return &pieceWork{
+		index:  index,
+		hash:   t.TF.PieceHashes[index],
+		length: t.calculatePieceSize(index),
+	}
+}
+
+// the channel closed the next time a piece or block is given back, so
+// peers with nothing to pick can sleep until there may be work again
+func (t *Torrent) currentWorkSignal() chan struct{} {
+	t.signalMu.Lock()
+	defer t.signalMu.Unlock()
+	return t.workSignal
+}
+
+func (t *Torrent) abortPiece(index int) {
+	t.Picker.Abort(index)
+	t.signalWork()
+}
+
+// wakes the peers waiting for work, a piece or blocks were given back
+func (t *Torrent) signalWork() {
+	t.signalMu.Lock()
+	defer t.signalMu.Unlock()
+	close(t.workSignal)
+	t.workSignal = make(chan struct{})
+}
+
+// blocks until the peer sends something or other peers give pieces back,
+// keeping the connection alive while we wait
+func (t *Torrent) waitForWork(p *peerConn) error {
+	signal := t.currentWorkSignal()
+	keepAlive := time.NewTimer(keepAliveInterval)
+	defer keepAlive.Stop()
+	// blocks the peer rejected may be asked for again soon
+	var retry <-chan time.Time
+	if t.rejectedAny(p.client) {
+		timer := time.NewTimer(rejectRetryDelay)
+		defer timer.Stop()
+		retry = timer.C
+	}
+
+	select {
+	case msg, ok := <-p.msgs:
+		if !ok {
+			return p.err
+		}
+		if msg == nil {
+			return nil
+		}
+		return t.handleMessage(p.client, msg)
+	case <-keepAlive.C:
+		return p.client.SendKeepAlive()
+	case <-signal:
+	case <-retry:
+	case <-t.complete:
+	}
+	return nil
+}
+
+func (t *Torrent) startDownload(peer torrentfile.Peer) error {
+	defer t.workers.Done()
+	defer t.releaseSlot()
+
+	client, err := client.New(peer, t.PeerID, t.TF.InfoHash, t.haveBitfield(), len(t.TF.PieceHashes))
+	t.dialDone()
 	if err != nil {
 		fmt.Printf("Could not handshake with peer %s, disconnecting\n", peer.String())
+		t.retryLater(peer, false)
 		return err
 	}
 
-	defer client.Conn.Close()
+	err = t.runPeer(client)
+	t.retryLater(peer, client.Downloaded() > 0)
+	return err
+}
 
-	client.SendUnchoke()
-	client.SendInterested()
+// downloads pieces from a connected peer until there is no work left and then
+// keeps serving it, used for both outbound and inbound connections
+func (t *Torrent) runPeer(client *client.Client) error {
+	// peers without any pieces may not have sent a bitfield at all
+	if len(client.Bitfield) < len(t.have) {
+		bf := bitfield.New(len(t.TF.PieceHashes))
+		copy(bf, client.Bitfield)
+		client.Bitfield = bf
+	}
 
-	for pw := range pwQueue {
-		if !client.Bitfield.HasPiece(pw.index) {
-			pwQueue <- pw
-			continue
-		}
+	client.SetLimits(t.DownloadLimit, t.UploadLimit)
 
-		pr, err := downloadPiece(client, pw)
-		if err != nil {
-			pwQueue <- pw
-			return err
-		}
+	state := &peerState{seed: isSeed(client.Bitfield, len(t.TF.PieceHashes))}
+	state.choke.connected = time.Now()
+	state.choke.lastBlock = state.choke.connected
+	if client.Supports(handshake.FastExtension) {
+		state.allowedFast = allowedFastSet(client.Peer().IP, t.TF.InfoHash, len(t.TF.PieceHashes))
+	}
+	// private torrents only learn about peers from their trackers
+	if !t.TF.Private && client.Supports(handshake.ExtensionProtocol) {
+		state.pex = newPexPeer(t)
+	}
+	if !t.addConn(client, state) {
+		client.Conn.Close()
+		return fmt.Errorf("Already connected to peer %s", client.Conn.RemoteAddr())
+	}
+	defer t.removeConn(client)
 
-		valid, err := validatePiece(pw.hash, pr.buf)
-		if !valid {
-			pwQueue <- pw
-			return err
-		}
+	// extensions have to be in place before the first message is handled
+	err := t.startExtensions(client, state)
+	if err != nil {
+		client.Conn.Close()
+		return err
+	}
 
-		err = client.SendHave(pw.index)
+	for index := range state.allowedFast {
+		err := client.SendAllowedFast(index)
 		if err != nil {
+			client.Conn.Close()
 			return err
 		}
+	}
+
+	p := newPeerConn(client)
+	defer p.close()
+
+	t.Picker.PeerBitfield(client.Bitfield)
+	defer t.Picker.PeerLeft(client.Bitfield)
 
-		cli.ProgressBar(cap(pwQueue)-len(pwQueue), cap(pwQueue))
-		prQueue <- pr
+	// peers stay choked until the choker gives them an upload slot
+	err = t.updateInterest(client)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return t.download(p)
 }
 
-func (t Torrent) DownloadTorrent(outPath, resumePath string, resume bool) error {
+// the piece to request blocks of next from the peer: blocks nobody asked for
+// yet in pieces already started come first, then a new piece and once there
+// is none left the pieces other peers are still working on. While choked
+// only the allowed fast set is considered
+func (t *Torrent) pickDownload(c *client.Client) (pd *pieceDownload, endgame bool, ok bool) {
+	peer := c.Bitfield
+	if c.Choked {
+		peer = bitfield.New(len(t.TF.PieceHashes))
+		for index := range c.AllowedFast {
+			if c.Bitfield.HasPiece(index) {
+				peer.SetPiece(index)
+			}
+		}
+	}
 
-	pieceWorkQueue := make(chan *pieceWork, len(t.TF.PieceHashes))
-	pieceResultQueue := make(chan *pieceResult, len(t.TF.PieceHashes))
+	pd, ok = t.joinPartial(c, peer.HasPiece)
+	if ok {
+		return pd, false, true
+	}
+	index, ok := t.Picker.Pick(peer)
+	if !ok {
+		index, ok = t.Picker.PickEndgame(peer)
+		endgame = ok
+	}
+	if !ok {
+		return nil, false, false
+	}
+	return t.joinDownload(t.pieceWork(index)), endgame, true
+}
+
+func (t *Torrent) DownloadTorrent(outPath, resumePath string, resume bool) error {
+
+	numPieces := len(t.TF.PieceHashes)
+	t.prQueue = make(chan *pieceResult, numPieces)
+	t.complete = make(chan struct{})
+	t.workSignal = make(chan struct{})
+	t.downloads = make(map[int]*pieceDownload)
+	t.known = make(map[string]bool)
+	t.conns = make(map[*client.Client]*peerState)
+	t.stopped = make(chan struct{})
+	t.failures = make(map[string]int)
+	t.banned = make(map[string]bool)
+	t.bannedIPs = make(map[string]bool)
+	t.suspects = make(map[int][]blockRecord)
+	t.peersGone = make(chan struct{}, 1)
+	t.lastAnnounce = time.Now()
+	if t.Picker == nil {
+		t.Picker = NewRarestFirstPicker(numPieces)
+	}
+	if t.DownloadLimit == nil {
+		t.DownloadLimit = ratelimit.New(0)
+	}
+	if t.UploadLimit == nil {
+		t.UploadLimit = ratelimit.New(0)
+	}
 
 	var f *file.File
 	var err error
 
+	t.have = bitfield.New(numPieces)
+	numPiecesToDownload := numPieces
+
 	// for resuming a download
 	if !resume {
 		fmt.Println("Starting torrent...")
@@ -195,80 +494,127 @@ func (t Torrent) DownloadTorrent(outPath, resumePath string, resume bool) error
 		if err != nil {
 			return err
 		}
-
-		for index, pieceHash := range t.TF.PieceHashes {
-			pieceLength := t.calculatePieceSize(index)
-			pieceWorkQueue <- &pieceWork{
-				index:  index,
-				hash:   pieceHash,
-				length: pieceLength,
-			}
-		}
 	} else {
 		fmt.Println("Continuing torrent...")
-		f, err = file.Open(resumePath)
+		f, err = file.Open(resumePath, t.TF)
 		if err != nil {
 			return err
 		}
-		for index, pieceHash := range t.TF.PieceHashes {
-			pieceLength := t.calculatePieceSize(index)
-			pieceBuffer, err := f.ReadPieceFromFile(t.calcPieceBounds(index))
-			if err != nil {
-				return err
-			}
-			valid, err := validatePiece(pieceHash, pieceBuffer)
-			// add the piece to the queue if it contains an invalid hash (isn't in the file)
-			// probably pretty expensive, but validates against malicious byte injection into an empty file
-			// could just validate against 0's which is what the partial file should have instead of
-			// actual data due to the truncate
-			if !valid {
-				pieceWorkQueue <- &pieceWork{
-					index:  index,
-					hash:   pieceHash,
-					length: pieceLength,
-				}
-			}
+		numPiecesToDownload, err = t.checkPieces(f)
+		if err != nil {
+			f.Close()
+			return err
 		}
-		if len(pieceWorkQueue) == 0 {
-			return fmt.Errorf("Selected file is already a valid download of this torrent")
+		if numPiecesToDownload == 0 {
+			if !t.Seed {
+				return fmt.Errorf("Selected file is already a valid download of this torrent")
+			}
+			fmt.Println("Selected file is already a valid download of this torrent, seeding it")
 		}
-		fmt.Printf("There are %d pieces remaining to download.\n", len(pieceWorkQueue))
+		fmt.Printf("There are %d pieces remaining to download.\n", numPiecesToDownload)
 	}
 
 	defer func() {
-		if err := f.File.Close(); err != nil {
+		if err := f.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	numPiecesToDownload := len(pieceWorkQueue)
+	t.file = f
+	defer t.saveResume()
 
-	for _, peer := range t.Peers {
-		go t.startDownload(peer, pieceWorkQueue, pieceResultQueue)
+	if t.Listener != nil {
+		t.Listener.Add(t)
+		defer t.Listener.Remove(t)
+	}
+
+	// runs before the file is closed, no peer may read from it after that
+	defer t.stopPeers()
+
+	peers := t.Peers
+	t.Peers = nil
+	t.addPeers(peers)
+	go t.feedFromTrackers()
+	if !t.TF.Private {
+		if t.DHT != nil {
+			go t.feedFromDHT()
+		}
+		go t.pexLoop()
 	}
+	t.lastChoke = time.Now()
+	go t.chokeLoop()
 
 	// create a file the size of the torrent
 
+	resumeTicker := time.NewTicker(resumeInterval)
+	defer resumeTicker.Stop()
+	// short stall timeouts have to be checked more often to be noticed in time
+	stallTicker := time.NewTicker(min(stallCheckInterval, t.stallTimeout()/2))
+	defer stallTicker.Stop()
+	lastProgress := time.Now()
+	quit := t.quitSignal()
+
 	donePieces := 0
 	for donePieces < numPiecesToDownload {
-		result := <-pieceResultQueue
-		begin, end := t.calcPieceBounds(result.index)
-		err := f.WritePieceToFile(result.buf, begin, end)
-		if err != nil {
-			return err
+		select {
+		case result := <-t.prQueue:
+			begin, end := t.calcPieceBounds(result.index)
+			err := f.WritePieceToFile(result.buf, begin, end)
+			if err != nil {
+				return err
+			}
+			t.setHave(result.index)
+			// peers learn about the piece once it can be read back from disk
+			go t.broadcastHave(result.index)
+			donePieces++
+			lastProgress = time.Now()
+			cli.ProgressBar(donePieces, numPiecesToDownload)
+		case <-resumeTicker.C:
+			t.saveResume()
+		case <-stallTicker.C:
+			err := t.checkStall(lastProgress, donePieces, numPiecesToDownload)
+			if err != nil {
+				return err
+			}
+		case <-t.peersGone:
+			err := t.checkStall(lastProgress, donePieces, numPiecesToDownload)
+			if err != nil {
+				return err
+			}
+		case <-quit:
+			return t.shutdown(f)
 		}
-		donePieces++
 	}
 
-  fmt.Println()
+	fmt.Println()
 
-	close(pieceWorkQueue)
+	close(t.complete)
+	if numPiecesToDownload > 0 {
+		t.announceEvent("completed")
+	}
 
 	fmt.Println("Pieces written to file:", donePieces)
 	fmt.Println("Successfully downloaded the torrent")
 
-	if err != nil {
-		return err
+	if t.Seed {
+		if t.Listener == nil {
+			fmt.Println("Seeding until all peers disconnect...")
+			gone := make(chan struct{})
+			go func() {
+				t.workers.Wait()
+				close(gone)
+			}()
+			select {
+			case <-gone:
+			case <-quit:
+				return t.shutdown(f)
+			}
+		} else {
+			// new peers can keep connecting to us so seed until stopped
+			fmt.Printf("Seeding on port %d...\n", t.Listener.Port)
+			<-quit
+			return t.shutdown(f)
+		}
 	}
-  return nil
+	return nil
 }
@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"gotorrent/client"
+	"gotorrent/handshake"
+	"gotorrent/message"
+	"gotorrent/mse"
+	"gotorrent/torrentfile"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// a single file torrent over size random bytes, without trackers
+func testTorrent(t *testing.T, size, pieceLen int) (torrentfile.TorrentFile, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	var pieces []byte
+	for i := 0; i < size; i += pieceLen {
+		hash := sha1.Sum(data[i:min(i+pieceLen, size)])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"name":         "test",
+		"length":       size,
+		"piece length": pieceLen,
+		"pieces":       string(pieces),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := torrentfile.TorrentFile{InfoHash: sha1.Sum(buf.Bytes())}
+	err = tf.SetMetadata(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf, data
+}
+
+// a plaintext peer that has every piece of the torrent and answers requests
+type fakeSeed struct {
+	data     []byte
+	pieceLen int
+	ln       net.Listener
+	// called for every request with the block asked for, returns the block
+	// to send back or nil to ignore the request. Sends the data as is when nil
+	answer func(index, begin int, block []byte) []byte
+	// receives a value whenever a connection to the seed ended
+	hangups chan struct{}
+}
+
+func newFakeSeed(t *testing.T, data []byte, pieceLen int) *fakeSeed {
+	t.Helper()
+	s := &fakeSeed{data: data, pieceLen: pieceLen}
+	s.listen(t, "127.0.0.1")
+	return s
+}
+
+// starts accepting connections on the ip, answer has to be set before
+func (s *fakeSeed) listen(t *testing.T, ip string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skip("can't listen on", ip, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// the seed can't do the encryption handshake
+	client.Encryption = mse.Disabled
+	t.Cleanup(func() { client.Encryption = mse.Preferred })
+
+	s.ln = ln
+	s.hangups = make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *fakeSeed) peer() torrentfile.Peer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return torrentfile.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *fakeSeed) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.hangups <- struct{}{}
+	}()
+
+	theirs, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	ours := handshake.HandShake{Pstr: theirs.Pstr, InfoHash: theirs.InfoHash}
+	rand.Read(ours.PeerID[:])
+	conn.Write(ours.Serialize())
+
+	numPieces := (len(s.data) + s.pieceLen - 1) / s.pieceLen
+	bf := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf[i/8] |= 0x80 >> (i % 8)
+	}
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: bf}).Serialize())
+	conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgRequest || len(msg.Payload) != 12 {
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		offset := index*s.pieceLen + begin
+		if offset+length > len(s.data) {
+			return
+		}
+		block := s.data[offset : offset+length]
+		if s.answer != nil {
+			block = s.answer(index, begin, block)
+			if block == nil {
+				continue
+			}
+		}
+
+		payload := make([]byte, 8+len(block))
+		binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		copy(payload[8:], block)
+		_, err = conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestCompletedDownloadStopsPeers(t *testing.T) {
+	tf, data := testTorrent(t, 1<<20, 64<<10)
+	seed := newFakeSeed(t, data, 64<<10)
+	dir := t.TempDir()
+
+	tor := &Torrent{Peers: []torrentfile.Peer{seed.peer()}, PeerID: [20]byte{1}, TF: tf}
+	err := tor.DownloadTorrent(dir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "test.gtor"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded file doesn't match, %v", err)
+	}
+
+	// the peers were gone before the file was closed
+	tor.connsMu.Lock()
+	left := len(tor.conns)
+	tor.connsMu.Unlock()
+	if left != 0 {
+		t.Errorf("%d peers still connected after the download returned", left)
+	}
+	select {
+	case <-seed.hangups:
+	case <-time.After(time.Second):
+		t.Error("connection to the seed stayed open after the download returned")
+	}
+
+	// peers arriving afterwards are not let in
+	tor.addPeers([]torrentfile.Peer{seed.peer()})
+	c, _ := net.Pipe()
+	defer c.Close()
+	if tor.addConn(&client.Client{Conn: c}, &peerState{}) {
+		t.Error("a connection was registered after the download returned")
+	}
+}
@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/message"
+)
+
+// a connected peer with a goroutine reading its messages, so waiting on the
+// peer can be combined with timers and signals from the rest of the torrent
+// without read deadlines cutting a message in half
+type peerConn struct {
+	client *client.Client
+	msgs   chan *message.Message
+	done   chan struct{}
+	err    error
+}
+
+func newPeerConn(c *client.Client) *peerConn {
+	p := &peerConn{
+		client: c,
+		msgs:   make(chan *message.Message),
+		done:   make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+// msgs is closed once reading fails, err holds the reason
+func (p *peerConn) readLoop() {
+	defer close(p.msgs)
+	for {
+		msg, err := p.client.Read()
+		if err != nil {
+			p.err = err
+			return
+		}
+		select {
+		case p.msgs <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// closes the connection and stops the reader
+func (p *peerConn) close() {
+	close(p.done)
+	p.client.Conn.Close()
+}
@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/message"
+	"gotorrent/pex"
+	"gotorrent/torrentfile"
+	"net"
+	"time"
+)
+
+// how often peers are told about our connections, BEP 11 asks for no more
+// than once a minute
+const pexInterval = time.Minute
+
+// the ut_pex side of a connection
+type pexPeer struct {
+	t *Torrent
+	// the peers we told this peer about, keyed by address. Only touched by
+	// the pex loop
+	sent map[string]torrentfile.Peer
+}
+
+func newPexPeer(t *Torrent) *pexPeer {
+	return &pexPeer{t: t, sent: make(map[string]torrentfile.Peer)}
+}
+
+func (pp *pexPeer) Handshake(c *client.Client, hs *message.ExtendedHandshake) error {
+	return nil
+}
+
+// queues the peers the peer is connected to, dropped peers are left alone as
+// we may still reach them
+func (pp *pexPeer) Message(c *client.Client, payload []byte) error {
+	m, err := pex.Parse(payload)
+	if err != nil {
+		return err
+	}
+
+	peers := make([]torrentfile.Peer, 0, min(len(m.Added), pex.MaxPeers))
+	for _, p := range m.Added {
+		if len(peers) == pex.MaxPeers {
+			break
+		}
+		peers = append(peers, p.Addr)
+	}
+	pp.t.addPeers(peers)
+	return nil
+}
+
+// sends the peers connected since the last message and the ones that left
+func (pp *pexPeer) update(c *client.Client, current map[string]pex.Peer) error {
+	self, _ := listenAddr(c)
+
+	msg := pex.Message{}
+	for key, p := range current {
+		if len(msg.Added) == pex.MaxPeers {
+			break
+		}
+		if _, ok := pp.sent[key]; ok || key == self.String() {
+			continue
+		}
+		msg.Added = append(msg.Added, p)
+		pp.sent[key] = p.Addr
+	}
+	for key, addr := range pp.sent {
+		if len(msg.Dropped) == pex.MaxPeers {
+			break
+		}
+		if _, ok := current[key]; ok {
+			continue
+		}
+		msg.Dropped = append(msg.Dropped, addr)
+		delete(pp.sent, key)
+	}
+
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+	payload, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	return c.SendExtension(pex.ExtensionName, payload)
+}
+
+// what other peers are told about a peer we are connected to
+func pexFlags(c *client.Client, state *peerState) byte {
+	var flags byte
+	if c.Outbound() {
+		flags |= pex.FlagReachable
+	}
+	if state.seed {
+		flags |= pex.FlagSeed
+	}
+	if _, ok := c.Conn.RemoteAddr().(*net.UDPAddr); ok {
+		flags |= pex.FlagUTP
+	}
+	if c.Encrypted() {
+		flags |= pex.FlagEncryption
+	}
+	return flags
+}
+
+// tells every peer speaking ut_pex about our connections once a minute
+func (t *Torrent) pexLoop() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		t.connsMu.Lock()
+		current := make(map[string]pex.Peer, len(t.conns))
+		var targets []*client.Client
+		var states []*peerState
+		for c, state := range t.conns {
+			if addr, ok := listenAddr(c); ok {
+				current[addr.String()] = pex.Peer{Addr: addr, Flags: pexFlags(c, state)}
+			}
+			if state.pex != nil && c.PeerSupports(pex.ExtensionName) {
+				targets = append(targets, c)
+				states = append(states, state)
+			}
+		}
+		t.connsMu.Unlock()
+
+		for i, c := range targets {
+			states[i].pex.update(c, current)
+		}
+	}
+}
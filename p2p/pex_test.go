@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"gotorrent/mse"
+	"gotorrent/pex"
+	"net"
+	"testing"
+)
+
+// both ends of a pipe after the encryption handshake
+func msePipe(t *testing.T, policy mse.Policy) (*mse.Conn, *mse.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	skey := [20]byte{1}
+
+	received := make(chan *mse.Conn, 1)
+	go func() {
+		conn, err := mse.Receive(b, [][20]byte{skey}, policy)
+		if err != nil {
+			b.Close()
+		}
+		received <- conn
+	}()
+	ours, err := mse.Initiate(a, skey, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ours, <-received
+}
+
+func TestPexFlags(t *testing.T) {
+	plain, _ := net.Pipe()
+	defer plain.Close()
+	encrypted, _ := msePipe(t, mse.Required)
+
+	tests := []struct {
+		name  string
+		conn  net.Conn
+		seed  bool
+		flags byte
+	}{
+		{"plaintext", plain, false, 0},
+		{"plaintext seed", plain, true, pex.FlagSeed},
+		{"encrypted", encrypted, false, pex.FlagEncryption},
+		{"encrypted seed", encrypted, true, pex.FlagEncryption | pex.FlagSeed},
+	}
+	for _, tt := range tests {
+		flags := pexFlags(&client.Client{Conn: tt.conn}, &peerState{seed: tt.seed})
+		if flags != tt.flags {
+			t.Errorf("%s: flags %#x, want %#x", tt.name, flags, tt.flags)
+		}
+	}
+}
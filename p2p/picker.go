@@ -0,0 +1,164 @@
+package p2p
+
+import (
+	"gotorrent/bitfield"
+	"math/rand"
+	"sync"
+)
+
+// PiecePicker decides which piece to download next from a peer. It tracks how
+// many connected peers have each piece and which pieces are already being
+// downloaded or done, implementations must be safe for concurrent use
+type PiecePicker interface {
+	// a peer connected with the given bitfield
+	PeerBitfield(bf bitfield.Bitfield)
+	// a connected peer announced a new piece with MsgHave
+	PeerHave(index int)
+	// a peer with the given bitfield disconnected
+	PeerLeft(bf bitfield.Bitfield)
+	// reserves a piece the peer has that is neither done nor being
+	// downloaded, ok is false when there is no such piece
+	Pick(peer bitfield.Bitfield) (index int, ok bool)
+	// once no piece is left to reserve, returns a piece the peer has that
+	// is already being downloaded so the last pieces are fetched from
+	// several peers at once, ok is false outside of endgame
+	PickEndgame(peer bitfield.Bitfield) (index int, ok bool)
+	// marks a piece as downloaded and verified, it is never picked again
+	Done(index int)
+	// gives a reserved piece back so it can be picked again
+	Abort(index int)
+}
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	pieceReserved
+	pieceDone
+)
+
+// the first few pieces are picked at random rather than rarest first so we
+// quickly have something to trade, rare pieces tend to be slow to get
+const randomFirstPieces = 4
+
+type rarestFirstPicker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	done         int
+}
+
+func NewRarestFirstPicker(numPieces int) PiecePicker {
+	return &rarestFirstPicker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+	}
+}
+
+func (p *rarestFirstPicker) PeerBitfield(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+func (p *rarestFirstPicker) PeerHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *rarestFirstPicker) PeerLeft(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+func (p *rarestFirstPicker) Pick(peer bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	randomFirst := p.done < randomFirstPieces
+	picked := -1
+	candidates := 0
+
+	for i, state := range p.state {
+		if state != pieceMissing || !peer.HasPiece(i) {
+			continue
+		}
+
+		if picked >= 0 && !randomFirst {
+			if p.availability[i] > p.availability[picked] {
+				continue
+			}
+			if p.availability[i] < p.availability[picked] {
+				picked = i
+				candidates = 1
+				continue
+			}
+		}
+
+		// reservoir sampling picks uniformly between equally good pieces
+		candidates++
+		if rand.Intn(candidates) == 0 {
+			picked = i
+		}
+	}
+
+	if picked < 0 {
+		return 0, false
+	}
+	p.state[picked] = pieceReserved
+	return picked, true
+}
+
+func (p *rarestFirstPicker) PickEndgame(peer bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	picked := -1
+	candidates := 0
+	for i, state := range p.state {
+		if state == pieceMissing {
+			return 0, false
+		}
+		if state != pieceReserved || !peer.HasPiece(i) {
+			continue
+		}
+		candidates++
+		if rand.Intn(candidates) == 0 {
+			picked = i
+		}
+	}
+
+	if picked < 0 {
+		return 0, false
+	}
+	return picked, true
+}
+
+func (p *rarestFirstPicker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != pieceDone {
+		p.state[index] = pieceDone
+		p.done++
+	}
+}
+
+func (p *rarestFirstPicker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceReserved {
+		p.state[index] = pieceMissing
+	}
+}
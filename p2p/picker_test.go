@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"gotorrent/bitfield"
+	"testing"
+)
+
+// a bitfield holding the given pieces
+func pieces(numPieces int, indexes ...int) bitfield.Bitfield {
+	bf := bitfield.New(numPieces)
+	for _, i := range indexes {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// a picker over 8 pieces where piece i is held by i+1 peers
+func skewedPicker() PiecePicker {
+	p := NewRarestFirstPicker(8)
+	for peers := 0; peers < 8; peers++ {
+		var held []int
+		for i := peers; i < 8; i++ {
+			held = append(held, i)
+		}
+		p.PeerBitfield(pieces(8, held...))
+	}
+	return p
+}
+
+func TestPickerRandomFirstPieces(t *testing.T) {
+	all := bitfield.Full(8)
+	picked := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		p := skewedPicker()
+		index, ok := p.Pick(all)
+		if !ok {
+			t.Fatal("nothing picked from a peer with every piece")
+		}
+		picked[index] = true
+	}
+	// rarest first would only ever pick piece 0
+	if len(picked) < 2 {
+		t.Errorf("the first piece was always %v, not picked at random", picked)
+	}
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	p := skewedPicker()
+	all := bitfield.Full(8)
+	// once a few pieces are done the rarest are picked first
+	for i := 7; i > 7-randomFirstPieces; i-- {
+		p.Done(i)
+	}
+	for want := 0; want < 8-randomFirstPieces; want++ {
+		index, ok := p.Pick(all)
+		if !ok || index != want {
+			t.Fatalf("picked %d, %v, want the rarest piece %d", index, ok, want)
+		}
+	}
+	if index, ok := p.Pick(all); ok {
+		t.Errorf("picked %d with every piece reserved or done", index)
+	}
+
+	// an aborted piece can be picked again
+	p.Abort(2)
+	if index, ok := p.Pick(all); !ok || index != 2 {
+		t.Errorf("picked %d, %v, want the aborted piece", index, ok)
+	}
+}
+
+func TestPickerOnlyPicksWhatThePeerHas(t *testing.T) {
+	p := skewedPicker()
+	for i := 0; i < randomFirstPieces; i++ {
+		p.Done(i)
+	}
+	peer := pieces(8, 5, 7)
+	if index, ok := p.Pick(peer); !ok || index != 5 {
+		t.Errorf("picked %d, %v, want the rarer of the peer's pieces", index, ok)
+	}
+
+	// availability follows peers coming and going
+	p.PeerLeft(pieces(8, 7))
+	p.PeerLeft(pieces(8, 7))
+	p.PeerHave(6)
+	if index, ok := p.Pick(bitfield.Full(8)); !ok || index != 4 {
+		t.Errorf("picked %d, %v, want piece 4", index, ok)
+	}
+	if index, ok := p.Pick(bitfield.Full(8)); !ok || index != 7 {
+		t.Errorf("picked %d, %v, want piece 7 after two of its peers left", index, ok)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := NewRarestFirstPicker(4)
+	all := bitfield.Full(4)
+	p.PeerBitfield(all)
+
+	p.Done(0)
+	first, _ := p.Pick(all)
+	second, _ := p.Pick(all)
+	// a piece is still missing, so no endgame yet
+	if index, ok := p.PickEndgame(all); ok {
+		t.Fatalf("endgame picked %d while a piece was missing", index)
+	}
+
+	last, _ := p.Pick(all)
+	reserved := map[int]bool{first: true, second: true, last: true}
+	for i := 0; i < 20; i++ {
+		index, ok := p.PickEndgame(all)
+		if !ok || !reserved[index] {
+			t.Fatalf("endgame picked %d, %v, want a reserved piece", index, ok)
+		}
+	}
+	// only among the pieces the peer has
+	if index, ok := p.PickEndgame(pieces(4, 0, last)); !ok || index != last {
+		t.Errorf("endgame picked %d, %v, want %d", index, ok, last)
+	}
+	if index, ok := p.PickEndgame(pieces(4, 0)); ok {
+		t.Errorf("endgame picked %d from a peer with nothing we lack", index)
+	}
+
+	// done pieces are never picked again
+	p.Done(first)
+	p.Done(second)
+	p.Done(last)
+	if index, ok := p.PickEndgame(all); ok {
+		t.Errorf("endgame picked %d with every piece done", index)
+	}
+}
@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"gotorrent/client"
+	"math"
+	"time"
+)
+
+const (
+	// requests kept outstanding to a peer before its rate is known
+	initialPipeline = 5
+	// fewest requests kept outstanding to a peer
+	minPipeline = 2
+	// on top of a round trip, the requests outstanding to a peer should keep
+	// it busy for this long so it never waits on us
+	pipelineSlack = 500 * time.Millisecond
+	// the rate of a peer is sampled over at least this long
+	rateWindow = 250 * time.Millisecond
+)
+
+// sizes the request queue of a peer from how fast it sends and how long it
+// takes to answer, so the queue holds what the peer can send in a round trip
+// plus some slack. A peer limited by the queue rather than its link sends
+// faster as the queue grows, which grows the queue further until the link is
+// saturated. Owned by the peer goroutine
+type pipeline struct {
+	depth int
+	// bytes per second, 0 until the first sample
+	rate       float64
+	sampled    time.Time
+	downloaded int64
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{depth: initialPipeline}
+}
+
+// samples the peer's rate once the window passed and resizes the queue
+func (pl *pipeline) update(c *client.Client, now time.Time) {
+	downloaded := c.Downloaded()
+	if pl.sampled.IsZero() {
+		pl.sampled, pl.downloaded = now, downloaded
+		return
+	}
+
+	rtt := c.MinLatency()
+	elapsed := now.Sub(pl.sampled)
+	if elapsed < max(rateWindow, 2*rtt) {
+		return
+	}
+	sample := float64(downloaded-pl.downloaded) / elapsed.Seconds()
+	if pl.rate == 0 {
+		pl.rate = sample
+	} else {
+		pl.rate = (pl.rate + sample) / 2
+	}
+	pl.sampled, pl.downloaded = now, downloaded
+
+	pl.depth = int(math.Ceil(pl.rate * (2*rtt + pipelineSlack).Seconds() / blockSize))
+}
+
+// the queue ran empty for lack of blocks to request, the time until it
+// fills again says nothing about the peer's rate
+func (pl *pipeline) idle() {
+	pl.sampled = time.Time{}
+}
+
+// the number of requests to keep outstanding, never more than the reqq the
+// peer queues, even when that is below minPipeline
+func (pl *pipeline) size(reqq int) int {
+	return min(max(minPipeline, pl.depth), reqq)
+}
+
+// how many requests the peer said it queues, our own limit when it didn't
+func peerQueue(c *client.Client) int {
+	if hs := c.PeerExtensions(); hs != nil && hs.Reqq > 0 {
+		return hs.Reqq
+	}
+	return maxQueuedRequests
+}
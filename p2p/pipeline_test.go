@@ -0,0 +1,107 @@
+package p2p
+
+import (
+	"gotorrent/torrentfile"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipelineSizeCappedByReqq(t *testing.T) {
+	tests := []struct {
+		depth, reqq, want int
+	}{
+		{1, 250, minPipeline},
+		{1, 1, 1},
+		{100, 10, 10},
+		{100, 250, 100},
+	}
+	for _, tt := range tests {
+		pl := &pipeline{depth: tt.depth}
+		if got := pl.size(tt.reqq); got != tt.want {
+			t.Errorf("depth %d with reqq %d: %d requests, want %d", tt.depth, tt.reqq, got, tt.want)
+		}
+	}
+}
+
+// forwards connections to the target, holding back everything sent either
+// way for delay without limiting the bandwidth
+func latencyProxy(t *testing.T, target torrentfile.Peer, delay time.Duration) torrentfile.Peer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	type chunk struct {
+		data []byte
+		due  time.Time
+	}
+	forward := func(dst, src net.Conn) {
+		chunks := make(chan chunk, 1<<16)
+		go func() {
+			defer dst.Close()
+			for c := range chunks {
+				time.Sleep(time.Until(c.due))
+				_, err := dst.Write(c.data)
+				if err != nil {
+					return
+				}
+			}
+		}()
+		defer close(chunks)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				chunks <- chunk{append([]byte{}, buf[:n]...), time.Now().Add(delay)}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			in, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", target.String())
+			if err != nil {
+				in.Close()
+				continue
+			}
+			go forward(out, in)
+			go forward(in, out)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return torrentfile.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestPipelineFillsHighLatencyLink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("downloads several megabytes through a slow link")
+	}
+	size := 8 << 20
+	tf, data := testTorrent(t, size, 256<<10)
+	seed := newFakeSeed(t, data, 256<<10)
+	delay := 25 * time.Millisecond
+
+	tor := &Torrent{Peers: []torrentfile.Peer{latencyProxy(t, seed.peer(), delay)}, PeerID: [20]byte{1}, TF: tf}
+	start := time.Now()
+	err := tor.DownloadTorrent(t.TempDir(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := float64(size) / time.Since(start).Seconds()
+
+	// a queue fixed at its initial size gets that many blocks per round trip
+	fixed := float64(initialPipeline*blockSize) / (2 * delay).Seconds()
+	t.Logf("%.2f MiB/s, a fixed queue of %d manages at most %.2f MiB/s", rate/(1<<20), initialPipeline, fixed/(1<<20))
+	if rate < 2*fixed {
+		t.Errorf("the request queue didn't grow to fill the round trip")
+	}
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"fmt"
+	"gotorrent/file"
+	"time"
+)
+
+// how often the fast resume data is written while downloading
+const resumeInterval = 30 * time.Second
+
+// works out which pieces of a partial download we already have, trusting the
+// fast resume data for pieces whose files haven't changed since it was written
+// and hashing everything else. Returns the number of pieces left to download
+func (t *Torrent) checkPieces(f *file.File) (int, error) {
+	numPieces := len(t.TF.PieceHashes)
+	remaining := numPieces
+
+	resume, err := f.LoadResume(t.TF.InfoHash, numPieces)
+	if err != nil {
+		fmt.Println("No usable resume data, checking every piece:", err)
+	}
+
+	rechecked := 0
+	for index, pieceHash := range t.TF.PieceHashes {
+		// a full recheck of a large torrent takes a while, Stop must not
+		// wait for it
+		if t.isQuitting() {
+			return 0, ErrStopped
+		}
+		begin, end := t.calcPieceBounds(index)
+
+		var valid bool
+		if resume != nil && resume.Unchanged(begin, end) {
+			valid = resume.Have.HasPiece(index)
+		} else {
+			pieceBuffer, err := f.ReadPieceFromFile(begin, end)
+			if err != nil {
+				return 0, err
+			}
+			// only pieces with a valid hash count as downloaded
+			// probably pretty expensive, but validates against malicious byte injection into an empty file
+			// could just validate against 0's which is what the partial file should have instead of
+			// actual data due to the truncate
+			valid, _ = validatePiece(pieceHash, pieceBuffer)
+			rechecked++
+		}
+
+		if valid {
+			t.have.SetPiece(index)
+			t.Picker.Done(index)
+			remaining--
+		}
+	}
+
+	if resume != nil {
+		fmt.Printf("Used resume data, rechecked %d of %d pieces.\n", rechecked, numPieces)
+	}
+	return remaining, nil
+}
+
+// writes the fast resume data, failures only cost a full recheck later so
+// they are reported and otherwise ignored
+func (t *Torrent) saveResume() {
+	err := t.file.SaveResume(t.TF.InfoHash, t.haveBitfield())
+	if err != nil {
+		fmt.Println("Could not save resume data:", err)
+	}
+}
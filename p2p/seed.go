@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"fmt"
+	"gotorrent/bitfield"
+	"gotorrent/client"
+	"gotorrent/handshake"
+	"gotorrent/message"
+	"time"
+)
+
+const (
+	// largest block we serve, requests for more are dropped as most clients do
+	maxRequestLength = 128 * 1024
+
+	// peers send keep alives every two minutes, three missed ones means gone
+	keepAliveInterval = 2 * time.Minute
+	peerIdleTimeout   = 3 * keepAliveInterval
+)
+
+// copy of the pieces we have verified and written, safe to hand to peers
+func (t *Torrent) haveBitfield() bitfield.Bitfield {
+	t.haveMu.RLock()
+	defer t.haveMu.RUnlock()
+
+	bf := make(bitfield.Bitfield, len(t.have))
+	copy(bf, t.have)
+	return bf
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.haveMu.RLock()
+	defer t.haveMu.RUnlock()
+	return t.have.HasPiece(index)
+}
+
+func (t *Torrent) setHave(index int) {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	t.have.SetPiece(index)
+}
+
+// handles the messages that can arrive at any point of a connection,
+// whether we are downloading from the peer or only seeding to it
+func (t *Torrent) handleMessage(c *client.Client, msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgUnchoke:
+		c.Choked = false
+		t.clearRejects(c)
+	case message.MsgChoke:
+		c.Choked = true
+		if !c.Supports(handshake.FastExtension) {
+			t.requeueAll(c)
+		}
+	case message.MsgInterested:
+		return t.setInterest(c, true)
+	case message.MsgNotInterested:
+		return t.setInterest(c, false)
+	case message.MsgHave:
+		index, err := msg.ParseHavePiece(msg)
+		if err != nil {
+			return err
+		}
+		return t.peerHas(c, index)
+	case message.MsgRequest:
+		return t.serveRequest(c, msg)
+	case message.MsgPiece:
+		pd, err := t.receiveBlock(c, msg)
+		if err != nil {
+			return err
+		}
+		if pd != nil {
+			return t.finishPiece(c, pd)
+		}
+	case message.MsgReject:
+		return t.handleReject(c, msg)
+	case message.MsgAllowedFast:
+		index, err := msg.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if c.AllowedFast == nil {
+			c.AllowedFast = make(map[int]bool)
+		}
+		c.AllowedFast[index] = true
+	case message.MsgSuggest, message.MsgHaveAll, message.MsgHaveNone:
+		// suggestions are only hints and have all or have none are only
+		// meaningful in place of the bitfield, where the client handles them
+	case message.MsgExtended:
+		return c.HandleExtended(msg)
+	}
+	return nil
+}
+
+// answers a block request with data read back from disk, requests for pieces
+// we haven't verified yet are ignored
+func (t *Torrent) serveRequest(c *client.Client, msg *message.Message) error {
+	index, begin, length, err := msg.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	// peers with the fast extension are told about requests we won't serve
+	// rather than left waiting for them
+	if (t.isChoking(c) && !t.allowedFast(c, index)) || index < 0 || index >= len(t.TF.PieceHashes) || !t.hasPiece(index) {
+		if c.Supports(handshake.FastExtension) {
+			return c.SendReject(index, begin, length)
+		}
+		return nil
+	}
+	if length <= 0 || length > maxRequestLength {
+		return fmt.Errorf("Peer requested invalid block length %d", length)
+	}
+
+	pieceBegin, pieceEnd := t.calcPieceBounds(index)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return fmt.Errorf("Peer requested block [%d,%d) outside of piece %d", begin, begin+length, index)
+	}
+
+	block, err := t.file.ReadPieceFromFile(pieceBegin+begin, pieceBegin+begin+length)
+	if err != nil {
+		return err
+	}
+
+	err = c.SendPiece(index, begin, block)
+	if err != nil {
+		return err
+	}
+	t.uploaded.Add(int64(len(block)))
+	return nil
+}
+
+// keeps the connection open after our download is done so the peer can keep
+// requesting pieces, returns once the peer goes away
+func (t *Torrent) serve(p *peerConn) error {
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	idle := time.NewTimer(peerIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case msg, ok := <-p.msgs:
+			if !ok {
+				return p.err
+			}
+			idle.Reset(peerIdleTimeout)
+			if msg == nil {
+				continue
+			}
+
+			err := t.handleMessage(p.client, msg)
+			if err != nil {
+				return err
+			}
+		case <-keepAlive.C:
+			err := p.client.SendKeepAlive()
+			if err != nil {
+				return err
+			}
+		case <-idle.C:
+			return fmt.Errorf("Peer %s went idle", p.client.Conn.RemoteAddr())
+		}
+	}
+}
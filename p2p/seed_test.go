@@ -0,0 +1,186 @@
+package p2p
+
+import (
+	"bytes"
+	"gotorrent/bitfield"
+	"gotorrent/client"
+	"gotorrent/file"
+	"gotorrent/handshake"
+	"gotorrent/message"
+	"net"
+	"testing"
+	"time"
+)
+
+// a torrent that has every piece of its file on disk and serves it
+func seedingTorrent(t *testing.T, size, pieceLen int) (*Torrent, []byte) {
+	t.Helper()
+	tf, data := testTorrent(t, size, pieceLen)
+	f, err := file.New(t.TempDir(), tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	err = f.WritePieceToFile(data, 0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor := &Torrent{TF: tf, file: f, conns: make(map[*client.Client]*peerState)}
+	tor.have = bitfield.Full(len(tf.PieceHashes))
+	return tor, data
+}
+
+// a connection from a peer speaking the fast extension, choked by us. The
+// returned conn is the peer's side with our handshake already read
+func fastPeer(t *testing.T, tor *Torrent) (*client.Client, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen on 127.0.0.1", err)
+	}
+	defer ln.Close()
+	theirs, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+
+	hs := handshake.HandShake{Pstr: "BitTorrent protocol", InfoHash: tor.TF.InfoHash}
+	hs.Reserved.Set(handshake.FastExtension)
+	theirs.Write((&message.Message{ID: message.MsgHaveNone}).Serialize())
+	numPieces := len(tor.TF.PieceHashes)
+	c, err := client.Accept(ours, &hs, [20]byte{1}, tor.have, numPieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// our handshake and have all
+	_, err = handshake.Read(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = message.Read(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor.conns[c] = &peerState{allowedFast: map[int]bool{}}
+	return c, theirs
+}
+
+// what the peer got back for a request, nil when nothing arrived
+func reply(t *testing.T, theirs net.Conn) *message.Message {
+	t.Helper()
+	theirs.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer theirs.SetReadDeadline(time.Time{})
+	msg, err := message.Read(theirs)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func TestServeRequest(t *testing.T) {
+	pieceLen := 256 << 10
+	tor, data := seedingTorrent(t, 4*pieceLen-1000, pieceLen)
+	c, theirs := fastPeer(t, tor)
+	c.Choking = false
+
+	// the longest block we serve, from the middle of a piece
+	b := message.Block{Index: 1, Begin: 1000, Length: maxRequestLength}
+	err := tor.serveRequest(c, message.FormatRequest(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := reply(t, theirs)
+	if msg == nil || msg.ID != message.MsgPiece {
+		t.Fatalf("got %v, want the block", msg)
+	}
+	offset := pieceLen + 1000
+	if !bytes.Equal(msg.Payload[8:], data[offset:offset+maxRequestLength]) {
+		t.Error("served the wrong data")
+	}
+	if tor.uploaded.Load() != maxRequestLength {
+		t.Errorf("counted %d bytes uploaded", tor.uploaded.Load())
+	}
+}
+
+func TestServeRequestRejects(t *testing.T) {
+	pieceLen := 256 << 10
+	tor, _ := seedingTorrent(t, 4*pieceLen-1000, pieceLen)
+	c, theirs := fastPeer(t, tor)
+	tor.have = bitfield.New(4)
+	tor.have.SetPiece(0)
+	tor.have.SetPiece(3)
+	tor.conns[c].allowedFast[3] = true
+
+	rejected := []struct {
+		name    string
+		b       message.Block
+		choking bool
+	}{
+		{"choked", message.Block{Index: 0, Begin: 0, Length: blockSize}, true},
+		{"piece we lack", message.Block{Index: 1, Begin: 0, Length: blockSize}, false},
+		{"piece out of range", message.Block{Index: 4, Begin: 0, Length: blockSize}, false},
+	}
+	for _, tt := range rejected {
+		c.Choking = tt.choking
+		err := tor.serveRequest(c, message.FormatRequest(tt.b))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		msg := reply(t, theirs)
+		if msg == nil || msg.ID != message.MsgReject || !bytes.Equal(msg.Payload, message.FormatReject(tt.b).Payload) {
+			t.Errorf("%s: got %v, want a reject", tt.name, msg)
+		}
+	}
+
+	// allowed fast pieces are served while choked
+	c.Choking = true
+	err := tor.serveRequest(c, message.FormatRequest(message.Block{Index: 3, Begin: 0, Length: blockSize}))
+	if msg := reply(t, theirs); err != nil || msg == nil || msg.ID != message.MsgPiece {
+		t.Errorf("got %v, %v for an allowed fast piece while choked", msg, err)
+	}
+
+	invalid := []struct {
+		name string
+		b    message.Block
+	}{
+		{"longer than 128 KiB", message.Block{Index: 0, Begin: 0, Length: maxRequestLength + 1}},
+		{"empty", message.Block{Index: 0, Begin: 0, Length: 0}},
+		{"past the end of the piece", message.Block{Index: 0, Begin: pieceLen - blockSize + 1, Length: blockSize}},
+		{"past the end of the last piece", message.Block{Index: 3, Begin: pieceLen - 1000 - blockSize + 1, Length: blockSize}},
+	}
+	c.Choking = false
+	for _, tt := range invalid {
+		err := tor.serveRequest(c, message.FormatRequest(tt.b))
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if msg := reply(t, theirs); msg != nil {
+			t.Errorf("%s: answered with %v", tt.name, msg)
+		}
+	}
+}
+
+func TestServeRequestIgnoresWithoutFastExtension(t *testing.T) {
+	tor, _ := seedingTorrent(t, 64<<10, 16<<10)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	c := &client.Client{Conn: ours, Choking: true}
+	tor.conns[c] = &peerState{}
+
+	// nothing is written, a write to the pipe would block without a reader
+	err := tor.serveRequest(c, message.FormatRequest(message.Block{Index: 0, Begin: 0, Length: blockSize}))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"gotorrent/file"
+	"time"
+)
+
+// ErrStopped is returned by DownloadTorrent once Stop shut the torrent down
+var ErrStopped = errors.New("Download stopped")
+
+const (
+	// how long the trackers get to hear about a completed download or that
+	// we stopped
+	eventAnnounceTimeout = 5 * time.Second
+)
+
+// Stop shuts the torrent down gracefully: no new blocks are requested, the
+// peer connections are closed, the pieces already downloaded are written, the
+// trackers are told we stopped and resume data is saved before
+// DownloadTorrent returns ErrStopped. Safe to call from any goroutine, more
+// than once and even before DownloadTorrent
+func (t *Torrent) Stop() {
+	quit := t.quitSignal()
+
+	t.quitMu.Lock()
+	defer t.quitMu.Unlock()
+	select {
+	case <-quit:
+	default:
+		close(quit)
+	}
+}
+
+// the channel closed by Stop
+func (t *Torrent) quitSignal() chan struct{} {
+	t.quitMu.Lock()
+	defer t.quitMu.Unlock()
+	if t.quit == nil {
+		t.quit = make(chan struct{})
+	}
+	return t.quit
+}
+
+func (t *Torrent) isQuitting() bool {
+	select {
+	case <-t.quitSignal():
+		return true
+	default:
+		return false
+	}
+}
+
+// winds the torrent down after Stop, peers stopped requesting blocks as
+// soon as it was called
+func (t *Torrent) shutdown(f *file.File) error {
+	fmt.Println()
+	fmt.Println("Stopping torrent...")
+
+	// no peer may queue a piece once the queue is drained
+	t.stopPeers()
+	written, err := t.flushPieces(f)
+	if err != nil {
+		return err
+	}
+	if written > 0 {
+		fmt.Printf("Wrote %d pieces that were waiting to be written\n", written)
+	}
+
+	t.announceEvent("stopped")
+	t.saveResume()
+	return ErrStopped
+}
+
+// writes the verified pieces still queued, returns how many there were
+func (t *Torrent) flushPieces(f *file.File) (int, error) {
+	written := 0
+	for {
+		select {
+		case result := <-t.prQueue:
+			begin, end := t.calcPieceBounds(result.index)
+			err := f.WritePieceToFile(result.buf, begin, end)
+			if err != nil {
+				return written, err
+			}
+			t.setHave(result.index)
+			written++
+		default:
+			return written, nil
+		}
+	}
+}
+
+// tells the trackers about a completed download or that we stopped, giving up
+// after eventAnnounceTimeout
+func (t *Torrent) announceEvent(event string) {
+	if len(t.TF.AnnounceList) == 0 {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// a reannounce still running would reorder the trackers under us
+		for !t.claimAnnounce() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		_, err := t.TF.AnnounceProgress(t.listenPort(), event, t.progress())
+		// once stopped no regular announce may put us back in the swarm
+		if event != "stopped" {
+			t.peersMu.Lock()
+			t.announcing = false
+			t.peersMu.Unlock()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Printf("Could not announce %s to the trackers: %v\n", event, err)
+		}
+	case <-time.After(eventAnnounceTimeout):
+		fmt.Printf("Trackers did not answer our %s announce in time\n", event)
+	}
+}
+
+// takes the announce slot so no reannounce starts, false while one runs
+func (t *Torrent) claimAnnounce() bool {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.announcing {
+		return false
+	}
+	t.announcing = true
+	return true
+}
+
+// stops dialing and accepting peers, closes every peer connection and waits
+// for their goroutines to return. Dials still handshaking are refused by
+// addConn once they finish. Safe to call more than once
+func (t *Torrent) stopPeers() {
+	t.peersMu.Lock()
+	select {
+	case <-t.stopped:
+	default:
+		close(t.stopped)
+	}
+	t.peersMu.Unlock()
+
+	t.connsMu.Lock()
+	for c := range t.conns {
+		c.Conn.Close()
+	}
+	t.connsMu.Unlock()
+	t.running.Wait()
+}
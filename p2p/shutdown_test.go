@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"gotorrent/torrentfile"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStopKeepsEveryVerifiedPiece(t *testing.T) {
+	pieceLen := 2 * blockSize
+	tf, data := testTorrent(t, 64*pieceLen, pieceLen)
+
+	var mu sync.Mutex
+	var events []string
+	var left int
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		left, _ = strconv.Atoi(r.URL.Query().Get("left"))
+		mu.Unlock()
+		// a slow tracker leaves the blocks in flight time to arrive
+		if r.URL.Query().Get("event") == "stopped" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tf.Announce = tracker.URL + "/announce"
+	tf.AnnounceList = [][]string{{tf.Announce}}
+
+	tor := &Torrent{PeerID: [20]byte{1}, TF: tf}
+	// stops the torrent a third of the way in, the blocks already requested
+	// keep coming in after that
+	served := 0
+	seed := &fakeSeed{data: data, pieceLen: pieceLen, answer: func(index, begin int, block []byte) []byte {
+		mu.Lock()
+		served++
+		stop, stopped := served == 41, served > 40
+		mu.Unlock()
+		if stop {
+			tor.Stop()
+		}
+		if stopped {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return block
+	}}
+	seed.listen(t, "127.0.0.1")
+	tor.Peers = []torrentfile.Peer{seed.peer()}
+
+	dir := t.TempDir()
+	err := tor.DownloadTorrent(dir, "", false)
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("got %v, want ErrStopped", err)
+	}
+
+	if len(tor.prQueue) != 0 {
+		t.Errorf("%d verified pieces were left unwritten", len(tor.prQueue))
+	}
+	tor.connsMu.Lock()
+	connected := len(tor.conns)
+	tor.connsMu.Unlock()
+	if connected != 0 {
+		t.Errorf("%d peers still connected after stopping", connected)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dir, "test.gtor"))
+	have := 0
+	for i := range tf.PieceHashes {
+		if !tor.hasPiece(i) {
+			continue
+		}
+		have++
+		if !bytes.Equal(got[i*pieceLen:(i+1)*pieceLen], data[i*pieceLen:(i+1)*pieceLen]) {
+			t.Errorf("piece %d is marked as had but isn't on disk", i)
+		}
+	}
+	if have == 0 || have == len(tf.PieceHashes) {
+		t.Fatalf("had %d pieces when stopped", have)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 || events[len(events)-1] != "stopped" {
+		t.Fatalf("tracker events %q, want stopped last", events)
+	}
+	if want := len(data) - have*pieceLen; left != want {
+		t.Errorf("announced %d bytes left, want %d", left, want)
+	}
+}
+
+func TestStopDuringRecheck(t *testing.T) {
+	tf, data := testTorrent(t, 1<<20, 64<<10)
+	path := filepath.Join(t.TempDir(), "test.gtor")
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped before the pieces of the file were checked
+	tor := &Torrent{PeerID: [20]byte{1}, TF: tf}
+	tor.Stop()
+	err = tor.DownloadTorrent("", path, true)
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("got %v, want ErrStopped", err)
+	}
+	for i := range tf.PieceHashes {
+		if tor.hasPiece(i) {
+			t.Fatal("the recheck kept going after Stop")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"gotorrent/client"
+	"gotorrent/torrentfile"
+	"net"
+)
+
+// a copy of a block that was part of a piece failing its hash check
+type blockRecord struct {
+	hash [20]byte
+	ip   string
+}
+
+// the ip a peer is banned by, peers reconnecting from another port are
+// still the same peer
+func peerIP(c *client.Client) string {
+	switch addr := c.Conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return c.Peer().IP.String()
+}
+
+// true when the peer may not be dialed, either because it kept failing or
+// because it sent us corrupt data. The caller holds peersMu
+func (t *Torrent) isBanned(peer torrentfile.Peer) bool {
+	return t.banned[peer.String()] || t.bannedIPs[peer.IP.String()]
+}
+
+// records who sent the blocks of a piece that failed its hash check. When a
+// single peer sent the whole piece it is banned right away, otherwise the
+// blocks are compared once the piece is downloaded again and passes
+func (t *Torrent) pieceFailed(pd *pieceDownload) {
+	records := make([]blockRecord, len(pd.from))
+	senders := make(map[string]bool)
+	for block := range pd.from {
+		begin, length := pd.blockBounds(block)
+		records[block] = blockRecord{hash: sha1.Sum(pd.buf[begin : begin+length]), ip: pd.from[block]}
+		senders[pd.from[block]] = true
+	}
+
+	if len(senders) == 1 {
+		t.ban(records[0].ip, pd.work.index)
+		return
+	}
+
+	t.banMu.Lock()
+	t.suspects[pd.work.index] = append(t.suspects[pd.work.index], records...)
+	t.banMu.Unlock()
+}
+
+// bans the peers that sent a block of an earlier failed copy of the piece
+// that differs from the block in the verified copy
+func (t *Torrent) pieceVerified(pd *pieceDownload) {
+	t.banMu.Lock()
+	records, ok := t.suspects[pd.work.index]
+	delete(t.suspects, pd.work.index)
+	t.banMu.Unlock()
+	if !ok {
+		return
+	}
+
+	numBlocks := len(pd.from)
+	offenders := make(map[string]bool)
+	for i, record := range records {
+		begin, length := pd.blockBounds(i % numBlocks)
+		if record.hash != sha1.Sum(pd.buf[begin:begin+length]) {
+			offenders[record.ip] = true
+		}
+	}
+	for ip := range offenders {
+		t.ban(ip, pd.work.index)
+	}
+}
+
+// bans an ip for the rest of the session and closes every connection we
+// have from it
+func (t *Torrent) ban(ip string, index int) {
+	t.peersMu.Lock()
+	if t.bannedIPs[ip] {
+		t.peersMu.Unlock()
+		return
+	}
+	t.bannedIPs[ip] = true
+	t.peersMu.Unlock()
+
+	fmt.Printf("Banning peer %s, it sent corrupt data for piece %d\n", ip, index)
+
+	t.connsMu.Lock()
+	for c := range t.conns {
+		if peerIP(c) == ip {
+			c.Conn.Close()
+		}
+	}
+	t.connsMu.Unlock()
+}
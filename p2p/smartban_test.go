@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"bytes"
+	"gotorrent/torrentfile"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSmartBanBlamesTheCorruptPeer(t *testing.T) {
+	pieceLen := 4 * blockSize
+	tf, data := testTorrent(t, 16*pieceLen, pieceLen)
+	good := newFakeSeed(t, data, pieceLen)
+
+	// corrupts the second block of every piece the first time it is asked
+	var mu sync.Mutex
+	corrupted := map[int]bool{}
+	bad := &fakeSeed{data: data, pieceLen: pieceLen, answer: func(index, begin int, block []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if begin != blockSize || corrupted[index] {
+			return block
+		}
+		corrupted[index] = true
+		return bytes.Repeat([]byte{0xff}, len(block))
+	}}
+	bad.listen(t, "127.0.0.2")
+
+	dir := t.TempDir()
+	tor := &Torrent{Peers: []torrentfile.Peer{bad.peer(), good.peer()}, PeerID: [20]byte{1}, TF: tf}
+	err := tor.DownloadTorrent(dir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "test.gtor"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+
+	mu.Lock()
+	sent := len(corrupted)
+	mu.Unlock()
+	if sent == 0 {
+		t.Fatal("the bad peer never sent a corrupt block")
+	}
+	tor.peersMu.Lock()
+	defer tor.peersMu.Unlock()
+	if !tor.bannedIPs["127.0.0.2"] {
+		t.Error("the peer that sent corrupt blocks was not banned")
+	}
+	if tor.bannedIPs["127.0.0.1"] {
+		t.Error("the honest peer was banned")
+	}
+}
+
+// a piece put together from several peers fails, only the peer whose block
+// differs from the copy that passed is banned
+func TestSmartBanComparesBlocks(t *testing.T) {
+	tor := &Torrent{
+		bannedIPs: make(map[string]bool),
+		suspects:  make(map[int][]blockRecord),
+	}
+	work := &pieceWork{index: 3, length: 3 * blockSize}
+	good := bytes.Repeat([]byte{1}, work.length)
+	corrupt := append([]byte{}, good...)
+	corrupt[blockSize+10] ^= 0xff
+
+	tor.pieceFailed(&pieceDownload{work: work, buf: corrupt, from: []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}})
+	if len(tor.bannedIPs) != 0 {
+		t.Fatal("banned a peer before the piece passed")
+	}
+	tor.pieceVerified(&pieceDownload{work: work, buf: good, from: []string{"10.0.0.3", "10.0.0.3", "10.0.0.3"}})
+
+	if !tor.bannedIPs["10.0.0.2"] || tor.bannedIPs["10.0.0.1"] || tor.bannedIPs["10.0.0.3"] {
+		t.Errorf("banned %v, want only the sender of the corrupt block", tor.bannedIPs)
+	}
+	if len(tor.suspects) != 0 {
+		t.Error("blocks of the failed copy were kept after the piece passed")
+	}
+}
+
+func TestBanCoversEveryPort(t *testing.T) {
+	tor := &Torrent{bannedIPs: make(map[string]bool), banned: make(map[string]bool)}
+	tor.ban("10.0.0.1", 0)
+	for _, port := range []uint16{6881, 51413} {
+		if !tor.isBanned(torrentfile.Peer{IP: []byte{10, 0, 0, 1}, Port: port}) {
+			t.Errorf("peer reconnecting from port %d is not banned", port)
+		}
+	}
+	if tor.isBanned(torrentfile.Peer{IP: []byte{10, 0, 0, 2}, Port: 6881}) {
+		t.Error("a peer on another ip was banned")
+	}
+}
@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// how often the download loop checks whether it is still getting pieces
+	stallCheckInterval = 30 * time.Second
+	// trackers are asked for fresh peers once no piece arrived for this long
+	stallReannounce = 2 * time.Minute
+	// the download gives up when no piece arrived for this long and
+	// Torrent.StallTimeout is 0
+	defaultStallTimeout = 10 * time.Minute
+)
+
+func (t *Torrent) stallTimeout() time.Duration {
+	if t.StallTimeout > 0 {
+		return t.StallTimeout
+	}
+	return defaultStallTimeout
+}
+
+func (t *Torrent) listenPort() uint16 {
+	if t.Listener == nil {
+		return 0
+	}
+	return t.Listener.Port
+}
+
+// true when no peer is connected or being dialed and none is queued
+func (t *Torrent) noPeers() bool {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	return t.active == 0 && len(t.candidates) == 0
+}
+
+// checks on the download after stallCheckInterval or when the last peer
+// went away, an error means the download should give up
+func (t *Torrent) checkStall(lastProgress time.Time, done, total int) error {
+	stalled := time.Since(lastProgress)
+	if stalled > t.stallTimeout() {
+		t.connsMu.Lock()
+		connected := len(t.conns)
+		t.connsMu.Unlock()
+		return fmt.Errorf("Download stalled, no piece arrived for %v with %d peers connected and %d of %d pieces done", stalled.Round(time.Second), connected, done, total)
+	}
+	if t.noPeers() || stalled > stallReannounce {
+		t.reannounce()
+	}
+	return nil
+}
+
+// wakes the download loop when the last peer is gone
+func (t *Torrent) signalNoPeers() {
+	select {
+	case t.peersGone <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,120 @@
+package pex
+
+import (
+	"bytes"
+	"gotorrent/torrentfile"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// the name the extension is registered under (BEP 11)
+const ExtensionName = "ut_pex"
+
+// peers added or dropped in a single message, more are sent in the next one
+const MaxPeers = 50
+
+// flags describing an added peer, one byte per peer
+const (
+	FlagEncryption = 0x01
+	// the peer is a seed or only uploads
+	FlagSeed      = 0x02
+	FlagUTP       = 0x04
+	FlagHolepunch = 0x08
+	// the sender connected to the peer so it accepts incoming connections
+	FlagReachable = 0x10
+)
+
+type Peer struct {
+	Addr  torrentfile.Peer
+	Flags byte
+}
+
+// Message lists the peers the sender connected to and disconnected from since
+// its last message, the first message lists every peer it is connected to
+type Message struct {
+	Added   []Peer
+	Dropped []torrentfile.Peer
+}
+
+type bencodePex struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+func isIPv4(p torrentfile.Peer) bool {
+	return p.IP.To4() != nil
+}
+
+func (m *Message) Serialize() ([]byte, error) {
+	var bp bencodePex
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+
+	for _, p := range m.Added {
+		if isIPv4(p.Addr) {
+			added = append(added, p.Addr.Compact()...)
+			addedF = append(addedF, p.Flags)
+		} else {
+			added6 = append(added6, p.Addr.Compact()...)
+			added6F = append(added6F, p.Flags)
+		}
+	}
+	for _, p := range m.Dropped {
+		if isIPv4(p) {
+			dropped = append(dropped, p.Compact()...)
+		} else {
+			dropped6 = append(dropped6, p.Compact()...)
+		}
+	}
+
+	bp.Added, bp.AddedF = string(added), string(addedF)
+	bp.Added6, bp.Added6F = string(added6), string(added6F)
+	bp.Dropped, bp.Dropped6 = string(dropped), string(dropped6)
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bp)
+	return buf.Bytes(), err
+}
+
+func Parse(payload []byte) (*Message, error) {
+	bp := bencodePex{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &bp)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	for _, list := range []struct {
+		peers string
+		flags string
+		ipv6  bool
+	}{{bp.Added, bp.AddedF, false}, {bp.Added6, bp.Added6F, true}} {
+		peers, err := torrentfile.UnmarshalPeers([]byte(list.peers), list.ipv6)
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range peers {
+			// flags are optional, peers without them get none
+			var flags byte
+			if i < len(list.flags) {
+				flags = list.flags[i]
+			}
+			m.Added = append(m.Added, Peer{Addr: p, Flags: flags})
+		}
+	}
+
+	for _, list := range []struct {
+		peers string
+		ipv6  bool
+	}{{bp.Dropped, false}, {bp.Dropped6, true}} {
+		peers, err := torrentfile.UnmarshalPeers([]byte(list.peers), list.ipv6)
+		if err != nil {
+			return nil, err
+		}
+		m.Dropped = append(m.Dropped, peers...)
+	}
+	return m, nil
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// a limiter lets through at most this much more than its rate after a
+	// quiet period, or one second worth of its rate when that is more
+	minBurst = 64 << 10
+	// waits are cut into sleeps of at most this so a new rate applies soon
+	maxSleep = 100 * time.Millisecond
+)
+
+// Limiter is a token bucket holding the bytes that may pass, refilled at
+// its rate. A rate of 0 or a nil Limiter lets everything through. Safe for
+// concurrent use, the rate can be changed while transfers wait on it
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter passing rate bytes per second, 0 for no limit
+func New(rate int) *Limiter {
+	return &Limiter{rate: max(rate, 0), last: time.Now()}
+}
+
+// Rate is the limit in bytes per second, 0 when unlimited
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit to rate bytes per second, 0 removes it
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = max(rate, 0)
+	l.tokens = min(l.tokens, l.burst())
+}
+
+func (l *Limiter) burst() float64 {
+	return float64(max(l.rate, minBurst))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), l.burst())
+	}
+	l.last = now
+}
+
+// Wait blocks until n bytes may pass. Transfers larger than the burst are
+// let through once the bucket is full and leave it in debt, so waiting
+// callers never starve behind them
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	for {
+		l.mu.Lock()
+		l.refill(time.Now())
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return
+		}
+		need := min(float64(n), l.burst())
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return
+		}
+		wait := time.Duration((need - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		time.Sleep(min(wait, maxSleep))
+	}
+}
@@ -0,0 +1,145 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+// builds the tracker tiers of a torrent as described in BEP 12, falling back
+// to a single tier holding the announce url when there is no announce-list.
+// trackers within a tier are shuffled once here and then only reordered when
+// one of them answers
+func buildTiers(announce string, announceList [][]string) [][]string {
+	tiers := make([][]string, 0, len(announceList))
+	for _, tier := range announceList {
+		trackers := make([]string, 0, len(tier))
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		tiers = append(tiers, trackers)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+	return tiers
+}
+
+// moves the tracker at index to the front of its tier so it is tried first on
+// the next announce
+func promote(tier []string, index int) {
+	tracker := tier[index]
+	copy(tier[1:index+1], tier[:index])
+	tier[0] = tracker
+}
+
+// what we tell the trackers about our transfer, all in bytes
+type Progress struct {
+	Downloaded int
+	Uploaded   int
+	Left       int
+}
+
+// announces to a single tracker over the protocol given by its url scheme,
+// event is empty for regular announces or one of "started", "completed" and
+// "stopped"
+func (t *TorrentFile) requestTrackerPeers(announce string, port uint16, event string, progress Progress) ([]Peer, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return t.requestUDPPeers(announce, port, event, progress)
+	case "http", "https":
+		return t.requestHTTPPeers(announce, port, event, progress)
+	default:
+		return nil, fmt.Errorf("Unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// a tracker that has not answered by then is given up on and the next one of
+// its tier is tried, its announce is left to finish in the background
+var trackerTimeout = 15 * time.Second
+
+type trackerResult struct {
+	peers []Peer
+	err   error
+}
+
+// announces to a single tracker, giving up after trackerTimeout
+func (t *TorrentFile) announceTracker(tracker string, port uint16, event string, progress Progress) ([]Peer, error) {
+	// buffered so an announce that is given up on never blocks
+	result := make(chan trackerResult, 1)
+	// and it must not see later changes to the torrent
+	tf := *t
+	go func() {
+		peers, err := tf.requestTrackerPeers(tracker, port, event, progress)
+		result <- trackerResult{peers: peers, err: err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.peers, r.err
+	case <-time.After(trackerTimeout):
+		return nil, fmt.Errorf("Tracker did not answer within %v", trackerTimeout)
+	}
+}
+
+// asks every tier for peers, failing over to the next tracker of a tier until
+// one answers and merging the peers of all the tiers that did. port is where
+// we accept incoming peer connections, the error is only returned when no
+// tier answered
+func (t *TorrentFile) AnnounceProgress(port uint16, event string, progress Progress) ([]Peer, error) {
+	if len(t.AnnounceList) == 0 {
+		return nil, fmt.Errorf("Torrent has no trackers")
+	}
+
+	seen := make(map[string]bool)
+	peers := []Peer{}
+	var errs []error
+	answered := false
+
+	for _, tier := range t.AnnounceList {
+		for index, tracker := range tier {
+			trackerPeers, err := t.announceTracker(tracker, port, event, progress)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", tracker, err))
+				continue
+			}
+
+			promote(tier, index)
+			answered = true
+			for _, peer := range trackerPeers {
+				if !seen[peer.String()] {
+					seen[peer.String()] = true
+					peers = append(peers, peer)
+				}
+			}
+			break
+		}
+	}
+
+	if !answered {
+		return nil, errors.Join(errs...)
+	}
+	return peers, nil
+}
+
+// the first announce of a torrent, before anything was transferred, it tells
+// the trackers we started
+func (t *TorrentFile) RequestPeers(port uint16) ([]Peer, error) {
+	return t.AnnounceProgress(port, "started", Progress{Left: t.left()})
+}
@@ -0,0 +1,118 @@
+package torrentfile
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildTiers(t *testing.T) {
+	tests := []struct {
+		name         string
+		announce     string
+		announceList [][]string
+		want         [][]string
+	}{
+		{"announce only", "http://a", nil, [][]string{{"http://a"}}},
+		{"list wins over announce", "http://a", [][]string{{"http://b"}, {"http://c"}}, [][]string{{"http://b"}, {"http://c"}}},
+		{"empty urls dropped", "", [][]string{{"", "http://b"}}, [][]string{{"http://b"}}},
+		{"empty tiers dropped", "", [][]string{{}, {""}, {"http://c"}}, [][]string{{"http://c"}}},
+		{"empty list falls back", "http://a", [][]string{{""}}, [][]string{{"http://a"}}},
+		{"no trackers", "", nil, [][]string{}},
+	}
+	for _, tt := range tests {
+		got := buildTiers(tt.announce, tt.announceList)
+		if !slices.EqualFunc(got, tt.want, slices.Equal[[]string]) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTiersShuffles(t *testing.T) {
+	list := [][]string{{"http://a", "http://b", "http://c"}, {"http://d"}}
+	orders := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		tiers := buildTiers("", list)
+		if len(tiers) != 2 || len(tiers[0]) != 3 || !slices.Equal(tiers[1], list[1]) {
+			t.Fatalf("tiers %v don't match %v", tiers, list)
+		}
+		for _, tracker := range list[0] {
+			if !slices.Contains(tiers[0], tracker) {
+				t.Fatalf("%s missing from the shuffled tier %v", tracker, tiers[0])
+			}
+		}
+		orders[tiers[0][0]+tiers[0][1]+tiers[0][2]] = true
+	}
+	if len(orders) < 2 {
+		t.Error("trackers within a tier were never shuffled")
+	}
+	if !slices.Equal(list[0], []string{"http://a", "http://b", "http://c"}) {
+		t.Error("the announce-list of the torrent was shuffled in place")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	tests := []struct {
+		tier  []string
+		index int
+		want  []string
+	}{
+		{[]string{"a"}, 0, []string{"a"}},
+		{[]string{"a", "b", "c"}, 0, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, 1, []string{"b", "a", "c"}},
+		{[]string{"a", "b", "c"}, 2, []string{"c", "a", "b"}},
+	}
+	for _, tt := range tests {
+		tier := slices.Clone(tt.tier)
+		promote(tier, tt.index)
+		if !slices.Equal(tier, tt.want) {
+			t.Errorf("promote(%v, %d) = %v, want %v", tt.tier, tt.index, tier, tt.want)
+		}
+	}
+}
+
+func TestAnnounceFailover(t *testing.T) {
+	ok := newFakeUDPTracker(t)
+	other := newFakeUDPTracker(t)
+	failing := newFakeUDPTracker(t)
+	failing.mu.Lock()
+	failing.failWith = "torrent not registered"
+	failing.mu.Unlock()
+	// rejected before anything is sent
+	unsupported := "wss://tracker.example/announce"
+
+	tests := []struct {
+		name  string
+		tiers [][]string
+		// the first tracker of every tier afterwards
+		heads []string
+		peers int
+	}{
+		{"first answers", [][]string{{ok.url(), failing.url()}}, []string{ok.url()}, 1},
+		{"second answers after an error", [][]string{{unsupported, ok.url()}}, []string{ok.url()}, 1},
+		{"second answers after a tracker error", [][]string{{failing.url(), unsupported, ok.url()}}, []string{ok.url()}, 1},
+		{"every tier asked", [][]string{{unsupported, ok.url()}, {failing.url(), other.url()}}, []string{ok.url(), other.url()}, 1},
+		{"failing tier left alone", [][]string{{unsupported, failing.url()}, {ok.url()}}, []string{unsupported, ok.url()}, 1},
+	}
+	for _, tt := range tests {
+		tf := testTorrentFile(tt.tiers...)
+		peers, err := tf.RequestPeers(6881)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		// both fake trackers hand out the same peer
+		if len(peers) != tt.peers {
+			t.Errorf("%s: got peers %v", tt.name, peers)
+		}
+		for i, head := range tt.heads {
+			if tf.AnnounceList[i][0] != head {
+				t.Errorf("%s: tier %d starts with %s, want %s", tt.name, i, tf.AnnounceList[i][0], head)
+			}
+		}
+	}
+
+	_, err := testTorrentFile([]string{unsupported, failing.url()}).RequestPeers(6881)
+	if err == nil {
+		t.Error("no error when every tracker failed")
+	}
+}
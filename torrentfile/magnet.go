@@ -0,0 +1,162 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// parses a magnet link into a torrent file that only knows its infohash and
+// trackers, the rest has to be filled in with SetMetadata once the info
+// dictionary has been fetched from peers
+func ParseMagnet(uri string) (TorrentFile, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if u.Scheme != "magnet" {
+		return TorrentFile{}, fmt.Errorf("%s is not a magnet link", uri)
+	}
+
+	params := u.Query()
+
+	var infohash [20]byte
+	found := false
+	for _, xt := range params["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		infohash, err = decodeInfoHash(encoded)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return TorrentFile{}, fmt.Errorf("Magnet link has no urn:btih infohash")
+	}
+
+	// each tracker gets its own tier so all of them are asked for peers
+	trackers := make([][]string, 0, len(params["tr"]))
+	for _, tr := range params["tr"] {
+		trackers = append(trackers, []string{tr})
+	}
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	tf := TorrentFile{
+		AnnounceList: buildTiers("", trackers),
+		PeerID:       peerID,
+		InfoHash:     infohash,
+		Name:         params.Get("dn"),
+	}
+	if len(tf.AnnounceList) > 0 {
+		tf.Announce = tf.AnnounceList[0][0]
+	}
+	return tf, nil
+}
+
+// infohashes in magnet links are either 40 hex or 32 base32 characters
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infohash [20]byte
+	var buf []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		buf, err = hex.DecodeString(encoded)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infohash, fmt.Errorf("Infohash %q has invalid length %d", encoded, len(encoded))
+	}
+	if err != nil {
+		return infohash, err
+	}
+
+	copy(infohash[:], buf)
+	return infohash, nil
+}
+
+// true once the info dictionary is known, torrents opened from a magnet link
+// start without it
+func (t *TorrentFile) HasMetadata() bool {
+	return t.InfoBytes != nil
+}
+
+// fills in the torrent from a fetched info dictionary after checking that it
+// matches the infohash
+func (t *TorrentFile) SetMetadata(infoBytes []byte) error {
+	if sha1.Sum(infoBytes) != t.InfoHash {
+		return fmt.Errorf("Metadata does not match infohash %x", t.InfoHash)
+	}
+
+	bto := bencodeTorrent{Announce: t.Announce}
+	err := bencode.Unmarshal(bytes.NewReader(infoBytes), &bto.Info)
+	if err != nil {
+		return err
+	}
+
+	tf, err := bto.toTorrentFile(infoBytes)
+	if err != nil {
+		return err
+	}
+	tf.PeerID = t.PeerID
+	tf.AnnounceList = t.AnnounceList
+
+	*t = tf
+	return nil
+}
+
+// writes the torrent out as a .torrent file, the info dictionary is written
+// byte for byte so the infohash stays the same
+func (t *TorrentFile) Save(path string) error {
+	if !t.HasMetadata() {
+		return fmt.Errorf("Torrent has no metadata to save")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("d")
+	if t.Announce != "" {
+		buf.WriteString("8:announce")
+		err := bencode.Marshal(&buf, t.Announce)
+		if err != nil {
+			return err
+		}
+	}
+	if len(t.AnnounceList) > 0 {
+		buf.WriteString("13:announce-list")
+		err := bencode.Marshal(&buf, t.AnnounceList)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteString("4:info")
+	buf.Write(t.InfoBytes)
+	buf.WriteString("e")
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// bytes left to download as reported to trackers, before the metadata is known
+// the size is unknown so report a non zero amount to still be seen as a leecher
+func (t *TorrentFile) left() int {
+	if !t.HasMetadata() {
+		return 1
+	}
+	return t.Length
+}
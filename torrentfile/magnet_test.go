@@ -0,0 +1,68 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"slices"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const infoHash = "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c"
+	tests := []struct {
+		name     string
+		uri      string
+		dn       string
+		trackers [][]string
+	}{
+		{"hex", "magnet:?xt=urn:btih:" + infoHash, "", [][]string{}},
+		{"upper case hex", "magnet:?xt=urn:btih:DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C", "", [][]string{}},
+		{"base32", "magnet:?xt=urn:btih:3WBFL3G4PSSV7MF37AJSHWDQMLNR63I4", "", [][]string{}},
+		{"lower case base32", "magnet:?xt=urn:btih:3wbfl3g4pssv7mf37ajshwdqmlnr63i4", "", [][]string{}},
+		{"display name", "magnet:?xt=urn:btih:" + infoHash + "&dn=Big+Buck+Bunny", "Big Buck Bunny", [][]string{}},
+		{"other xt first", "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + infoHash, "", [][]string{}},
+		{
+			"a tier per tracker",
+			"magnet:?xt=urn:btih:" + infoHash + "&tr=udp%3A%2F%2Fa%3A80&tr=http%3A%2F%2Fb%2Fannounce&tr=",
+			"",
+			[][]string{{"udp://a:80"}, {"http://b/announce"}},
+		},
+	}
+	for _, tt := range tests {
+		tf, err := ParseMagnet(tt.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := hex.EncodeToString(tf.InfoHash[:]); got != infoHash {
+			t.Errorf("%s: infohash %s, want %s", tt.name, got, infoHash)
+		}
+		if tf.Name != tt.dn {
+			t.Errorf("%s: name %q, want %q", tt.name, tf.Name, tt.dn)
+		}
+		if !slices.EqualFunc(tf.AnnounceList, tt.trackers, slices.Equal[[]string]) {
+			t.Errorf("%s: tiers %v, want %v", tt.name, tf.AnnounceList, tt.trackers)
+		}
+		if len(tt.trackers) > 0 && tf.Announce != tt.trackers[0][0] {
+			t.Errorf("%s: announce %q, want the first tracker", tt.name, tf.Announce)
+		}
+		if tf.HasMetadata() {
+			t.Errorf("%s: metadata before it was fetched", tt.name)
+		}
+	}
+}
+
+func TestParseMagnetRejects(t *testing.T) {
+	tests := []string{
+		"http://example.com/?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c",
+		"magnet:?dn=nothing",
+		"magnet:?xt=urn:sha1:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c",
+		"magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d",
+		"magnet:?xt=urn:btih:zz8255ecdc7ca55fb0bbf81323d87062db1f6d1c",
+		"magnet:?xt=urn:btih:1WBFL3G4PSSV7MF37AJSHWDQMLNR63I4",
+	}
+	for _, uri := range tests {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("parsed %q", uri)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package torrentfile
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// finds the exact bytes of the info dictionary inside a bencoded torrent, the
+// infohash has to be taken over these bytes rather than a re-encoding since
+// the typed struct drops any keys it doesn't know about
+func rawInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("Torrent file is not a bencoded dictionary")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyBegin := pos
+		keyEnd, err := skipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if data[keyBegin] < '0' || data[keyBegin] > '9' {
+			return nil, fmt.Errorf("Dictionary key at offset %d is not a string", keyBegin)
+		}
+
+		valueBegin := keyEnd
+		valueEnd, err := skipValue(data, valueBegin)
+		if err != nil {
+			return nil, err
+		}
+
+		if string(data[keyBegin:keyEnd]) == "4:info" {
+			if data[valueBegin] != 'd' {
+				return nil, fmt.Errorf("Info is not a dictionary")
+			}
+			return data[valueBegin:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+
+	return nil, fmt.Errorf("Torrent file has no info dictionary")
+}
+
+// returns the length of the bencoded value at the start of data, for messages
+// where raw bytes follow a bencoded dictionary
+func ValueLength(data []byte) (int, error) {
+	return skipValue(data, 0)
+}
+
+// returns the offset just past the bencoded value starting at pos
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("Unexpected end of bencoded data")
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("Unterminated integer at offset %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("Unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("Malformed string length at offset %d", pos)
+		}
+		length, err := strconv.Atoi(string(data[pos : pos+colon]))
+		if err != nil {
+			return 0, err
+		}
+		// compared before adding so a huge length can't overflow the offset
+		if length < 0 || length > len(data)-pos-colon-1 {
+			return 0, fmt.Errorf("String at offset %d runs past the end of the data", pos)
+		}
+		return pos + colon + 1 + length, nil
+	default:
+		return 0, fmt.Errorf("Unexpected byte %q at offset %d", c, pos)
+	}
+}
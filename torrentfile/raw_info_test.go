@@ -0,0 +1,115 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// torrents laid out like the ones real clients write, with info keys the typed
+// struct doesn't know about. The hashes are sha1 over the raw info bytes
+var infoHashVectors = []struct {
+	file     string
+	infoHash string
+	name     string
+	length   int
+}{
+	// private tracker torrent with the private flag and a source tag
+	{"private_source.torrent", "8c09fe36e7082ec59d13256e05e9d8293c22032a", "linux-distro.iso", 3*262144 - 17},
+	// mktorrent multi file torrent with an md5sum per file
+	{"multi_md5sum.torrent", "ef3c1d6ad33f47d7e627a0ccdacbe0a054c028e4", "Album", 3000},
+	// BEP 47 padding file attrs and a name.utf-8 copy of the name
+	{"padded_utf8.torrent", "2bfdcd53fbc37648c37cd9c705844bdf7245f3eb", "Stuff", 16434},
+	// keys out of canonical order, any re-encoding sorts them
+	{"unsorted_keys.torrent", "cbf2b6a4a4730c76235d3de57ace879f3fee0595", "x.bin", 40000},
+}
+
+func TestInfoHashFromRawBytes(t *testing.T) {
+	for _, v := range infoHashVectors {
+		tf, err := Open(filepath.Join("testdata", v.file))
+		if err != nil {
+			t.Errorf("%s: %v", v.file, err)
+			continue
+		}
+		if got := hex.EncodeToString(tf.InfoHash[:]); got != v.infoHash {
+			t.Errorf("%s: infohash %s, want %s", v.file, got, v.infoHash)
+		}
+		if tf.Name != v.name || tf.Length != v.length {
+			t.Errorf("%s: decoded %q of %d bytes, want %q of %d", v.file, tf.Name, tf.Length, v.name, v.length)
+		}
+	}
+}
+
+// published torrents checked against the infohash their publishers list. They
+// are not checked in, a missing one skips its check
+var publishedVectors = []struct {
+	file     string
+	url      string
+	infoHash string
+	name     string
+}{
+	// the WebTorrent sample, its magnet link is on webtorrent.io
+	{"big-buck-bunny.torrent", "https://webtorrent.io/torrents/big-buck-bunny.torrent", "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c", "Big Buck Bunny"},
+}
+
+func TestPublishedInfoHash(t *testing.T) {
+	for _, v := range publishedVectors {
+		path := filepath.Join("testdata", v.file)
+		if _, err := os.Stat(path); err != nil {
+			t.Logf("skipping %s, download it from %s", v.file, v.url)
+			continue
+		}
+		tf, err := Open(path)
+		if err != nil {
+			t.Errorf("%s: %v", v.file, err)
+			continue
+		}
+		if got := hex.EncodeToString(tf.InfoHash[:]); got != v.infoHash {
+			t.Errorf("%s: infohash %s, want %s", v.file, got, v.infoHash)
+		}
+		if tf.Name != v.name {
+			t.Errorf("%s: decoded name %q, want %q", v.file, tf.Name, v.name)
+		}
+	}
+}
+
+func TestValueLength(t *testing.T) {
+	tests := []struct {
+		data   string
+		length int
+	}{
+		{"i42e", 4},
+		{"4:spam", 6},
+		{"d8:msg_typei1e5:piecei0ee" + "raw piece bytes", 25},
+		{"l4:spami-3ee", 12},
+		{"0:", 2},
+	}
+	for _, tt := range tests {
+		n, err := ValueLength([]byte(tt.data))
+		if err != nil || n != tt.length {
+			t.Errorf("ValueLength(%q) = %d, %v, want %d", tt.data, n, err, tt.length)
+		}
+	}
+}
+
+func TestValueLengthRejectsMalformed(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"d9223372036854775807:xe",
+		"9223372036854775807:x",
+		"-1:x",
+		"5:abc",
+		"i42",
+		"d3:key",
+		"l",
+		"x",
+		"3abc",
+		"99999999999999999999:x",
+	} {
+		_, err := ValueLength([]byte(data))
+		if err == nil {
+			t.Errorf("ValueLength(%q) accepted malformed data", data)
+		}
+	}
+}
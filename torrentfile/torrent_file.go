@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -16,16 +17,24 @@ import (
 	"github.com/jackpal/bencode-go"
 )
 
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Private     int           `bencode:"private,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
 type Peer struct {
@@ -33,14 +42,28 @@ type Peer struct {
 	Port uint16
 }
 
+// a single file of the torrent, Offset is where the file starts inside the
+// torrent's contiguous byte stream of pieces
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
 type TorrentFile struct {
-	Announce    string
-	PeerID      [20]byte
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string
+	PeerID       [20]byte
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	InfoBytes    []byte
+	// private torrents (BEP 27) only get peers from their trackers
+	Private   bool
+	multiFile bool
 }
 
 type bencodeTrackerResponce struct {
@@ -48,18 +71,25 @@ type bencodeTrackerResponce struct {
 	Peers    string `bencode:"peers"`
 }
 
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
+func (p *Peer) String() (s string) {
+	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
+}
+
+// the compact form of the peer, 4 or 16 bytes of address followed by the port
+func (p *Peer) Compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), p.Port)
 }
 
-func (p *Peer) String() (s string) {
-	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
+// parses compact peers, ipv4 peers take 6 bytes and ipv6 peers 18
+func UnmarshalPeers(peersBin []byte, ipv6 bool) ([]Peer, error) {
+	if ipv6 {
+		return unmarshal6(peersBin)
+	}
+	return unmarshal(peersBin)
 }
 
 // parses peers IP addresses and ports from a buffer
@@ -81,6 +111,24 @@ func unmarshal(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// parses compact ipv6 peers, 16 bytes of address followed by the port
+func unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18
+	numPeers := len(peersBin) / peerSize
+	if len(peersBin)%peerSize != 0 {
+		err := fmt.Errorf("Received malformed ipv6 peers")
+		return nil, err
+	}
+	peers := make([]Peer, numPeers)
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+
+	return peers, nil
+}
+
 // pieces are pieces of a file that are hashed to ensure their validity as
 // we download them, and returns a dynamically allocated array of sha1 hashes
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -103,29 +151,75 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
-func (bto bencodeTorrent) toTorrentFile() (TorrentFile, error) {
+// builds the file list of the torrent, a single file torrent is treated as a
+// list containing just the one file so callers don't have to special case it
+func (i *bencodeInfo) splitFiles() ([]File, int, error) {
+	if len(i.Files) == 0 {
+		if i.Length <= 0 {
+			return nil, 0, fmt.Errorf("Torrent has no files and no length")
+		}
+		return []File{{Path: []string{i.Name}, Length: i.Length, Offset: 0}}, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	offset := 0
+	for index, f := range i.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("File %d has an empty path", index)
+		}
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("File %d has a negative length %d", index, f.Length)
+		}
+		files[index] = File{
+			Path:   f.Path,
+			Length: f.Length,
+			Offset: offset,
+		}
+		offset += f.Length
+	}
+	return files, offset, nil
+}
+
+func (bto bencodeTorrent) toTorrentFile(infoBytes []byte) (TorrentFile, error) {
 
-	infohash, err := bto.Info.hash()
+	infohash := sha1.Sum(infoBytes)
+
+	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	pieceHashes, err := bto.Info.splitPieceHashes()
+	files, length, err := bto.Info.splitFiles()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
+	// every piece but the last is piece length long, a torrent that doesn't
+	// add up would have us index past the piece hashes or the files
+	if bto.Info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("Torrent has an invalid piece length %d", bto.Info.PieceLength)
+	}
+	numPieces := (length + bto.Info.PieceLength - 1) / bto.Info.PieceLength
+	if len(pieceHashes) != numPieces {
+		return TorrentFile{}, fmt.Errorf("Torrent has %d piece hashes for %d pieces", len(pieceHashes), numPieces)
+	}
+
 	var peerID [20]byte
 	_, err = rand.Read(peerID[:])
 
 	tf := TorrentFile{
-		Announce:    bto.Announce,
-		PeerID:      peerID,
-		InfoHash:    infohash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: buildTiers(bto.Announce, bto.AnnounceList),
+		PeerID:       peerID,
+		InfoHash:     infohash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Files:        files,
+		InfoBytes:    infoBytes,
+		Private:      bto.Info.Private == 1,
+		multiFile:    len(bto.Info.Files) > 0,
 	}
 
 	tf.PrintTorrentFile()
@@ -141,20 +235,35 @@ func Open(path string) (TorrentFile, error) {
 	}
 	defer file.Close()
 
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	infoBytes, err := rawInfo(data)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bto.toTorrentFile()
+	return bto.toTorrentFile(infoBytes)
 }
 
 func (t *TorrentFile) PrintTorrentFile() {
-	fmt.Printf("Announce string: %s\nNum Pieces: %d\nPiece Length: %d\nLength: %d\nName: %s\nInfohash: %x\n", t.Announce, len(t.PieceHashes), t.PieceLength, t.Length, t.Name, string(t.InfoHash[:]))
+	fmt.Printf("Announce string: %s\nNum Pieces: %d\nPiece Length: %d\nLength: %d\nName: %s\nNum Files: %d\nInfohash: %x\n", t.Announce, len(t.PieceHashes), t.PieceLength, t.Length, t.Name, len(t.Files), string(t.InfoHash[:]))
 }
 
-func (t *TorrentFile) BuildTrackerUrl(port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+// true when the torrent describes a directory of files rather than one file
+func (t *TorrentFile) IsMultiFile() bool {
+	return t.multiFile
+}
+
+func (t *TorrentFile) BuildTrackerUrl(announce string, port uint16, event string, progress Progress) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
@@ -162,19 +271,22 @@ func (t *TorrentFile) BuildTrackerUrl(port uint16) (string, error) {
 		"info_hash":  []string{string(t.InfoHash[:])},
 		"peer_id":    []string{string(t.PeerID[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.Itoa(progress.Uploaded)},
+		"downloaded": []string{strconv.Itoa(progress.Downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(t.Length))},
+		"left":       []string{strconv.Itoa(progress.Left)},
+	}
+	if event != "" {
+		params.Set("event", event)
 	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (t *TorrentFile) RequestPeers() ([]Peer, error) {
-	var port uint16 = 6969
-	url, err := t.BuildTrackerUrl(port)
+// announces to a single http tracker
+func (t *TorrentFile) requestHTTPPeers(announce string, port uint16, event string, progress Progress) ([]Peer, error) {
+	url, err := t.BuildTrackerUrl(announce, port, event, progress)
 	if err != nil {
 		return nil, err
 	}
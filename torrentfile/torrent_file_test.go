@@ -0,0 +1,75 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestSetMetadataChecksPieces(t *testing.T) {
+	hash := strings.Repeat("x", 20)
+	tests := []struct {
+		name     string
+		length   int
+		pieceLen int
+		pieces   string
+		ok       bool
+	}{
+		{"exact pieces", 40000, 20000, hash + hash, true},
+		{"short last piece", 40001, 20000, hash + hash + hash, true},
+		{"zero piece length", 40000, 0, hash + hash, false},
+		{"negative piece length", 40000, -20000, hash + hash, false},
+		{"missing hash", 40001, 20000, hash + hash, false},
+		{"extra hash", 40000, 20000, hash + hash + hash, false},
+		{"no hashes", 40000, 20000, "", false},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := bencode.Marshal(&buf, map[string]interface{}{
+			"name":         "x.bin",
+			"length":       tt.length,
+			"piece length": tt.pieceLen,
+			"pieces":       tt.pieces,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tf := TorrentFile{InfoHash: sha1.Sum(buf.Bytes())}
+		err = tf.SetMetadata(buf.Bytes())
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted %d hashes for %d bytes in pieces of %d", tt.name, len(tt.pieces)/20, tt.length, tt.pieceLen)
+		}
+		if !tt.ok && tf.HasMetadata() {
+			t.Errorf("%s: metadata kept after it was refused", tt.name)
+		}
+	}
+}
+
+func TestSetMetadataChecksMultiFilePieces(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "Album",
+		"piece length": 1024,
+		// 3000 bytes need 3 pieces
+		"pieces": strings.Repeat("x", 40),
+		"files": []map[string]interface{}{
+			{"length": 1000, "path": []string{"a"}},
+			{"length": 2000, "path": []string{"b"}},
+		},
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := TorrentFile{InfoHash: sha1.Sum(buf.Bytes())}
+	if err := tf.SetMetadata(buf.Bytes()); err == nil {
+		t.Error("accepted 2 piece hashes for 3 pieces over several files")
+	}
+}
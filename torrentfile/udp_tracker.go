@@ -0,0 +1,230 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID uint64 = 0x41727101980
+
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionError    uint32 = 3
+
+	// BEP 15 allows n to go up to 8 which is over an hour of waiting, we give
+	// up after a single retransmission so failing over to the next tracker
+	// stays useful
+	udpMaxRetries = 1
+
+	// connection ids may be reused for a minute after they were received
+	udpConnectionIDLifetime = time.Minute
+)
+
+type udpConnectionID struct {
+	id       uint64
+	received time.Time
+}
+
+// connection ids handed out by udp trackers, keyed by the tracker host
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: make(map[string]udpConnectionID)}
+
+// BEP 15 waits 15 * 2^n seconds for a reply before retransmitting, we start
+// at 5 seconds so a dead tracker is given up on within 15
+var udpBaseTimeout = 5 * time.Second
+
+var errUDPTimeout = errors.New("udp tracker did not answer in time")
+
+// announce events as numbered by BEP 15, no event is 0
+var udpEvents = map[string]uint32{
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+}
+
+func cachedConnectionID(host string) (uint64, bool) {
+	udpConnectionIDs.Lock()
+	defer udpConnectionIDs.Unlock()
+
+	c, ok := udpConnectionIDs.ids[host]
+	if !ok || time.Since(c.received) > udpConnectionIDLifetime {
+		delete(udpConnectionIDs.ids, host)
+		return 0, false
+	}
+	return c.id, true
+}
+
+func cacheConnectionID(host string, id uint64) {
+	udpConnectionIDs.Lock()
+	defer udpConnectionIDs.Unlock()
+	udpConnectionIDs.ids[host] = udpConnectionID{id: id, received: time.Now()}
+}
+
+func forgetConnectionID(host string) {
+	udpConnectionIDs.Lock()
+	defer udpConnectionIDs.Unlock()
+	delete(udpConnectionIDs.ids, host)
+}
+
+func udpTimeout(n int) time.Duration {
+	return udpBaseTimeout * time.Duration(1<<n)
+}
+
+func newTransactionID() (uint32, error) {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// sends a request and waits for the reply with the matching transaction id,
+// replies to older retransmissions are skipped
+func udpTransaction(conn net.Conn, req []byte, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		res := buf[:n]
+		if binary.BigEndian.Uint32(res[0:4]) == udpActionError {
+			return nil, fmt.Errorf("udp tracker error: %s", string(res[8:]))
+		}
+		return res, nil
+	}
+}
+
+func udpConnect(conn net.Conn, timeout time.Duration) (uint64, error) {
+	transactionID, err := newTransactionID()
+	if err != nil {
+		return 0, err
+	}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+
+	res, err := udpTransaction(conn, req, transactionID, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 16 || binary.BigEndian.Uint32(res[0:4]) != udpActionConnect {
+		return 0, fmt.Errorf("Received malformed udp connect response")
+	}
+	return binary.BigEndian.Uint64(res[8:16]), nil
+}
+
+func (t *TorrentFile) udpAnnounce(conn net.Conn, connectionID uint64, port uint16, event string, progress Progress, timeout time.Duration) ([]Peer, error) {
+	transactionID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connectionID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+	copy(req[16:36], t.InfoHash[:])
+	copy(req[36:56], t.PeerID[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(progress.Downloaded)) // downloaded
+	binary.BigEndian.PutUint64(req[64:72], uint64(progress.Left))       // left
+	binary.BigEndian.PutUint64(req[72:80], uint64(progress.Uploaded))   // uploaded
+	binary.BigEndian.PutUint32(req[80:84], udpEvents[event])            // event
+	binary.BigEndian.PutUint32(req[84:88], 0)                           // ip, 0 means the sender
+	binary.BigEndian.PutUint32(req[88:92], udpKey)
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff) // num_want -1 means default
+	binary.BigEndian.PutUint16(req[96:98], port)
+
+	res, err := udpTransaction(conn, req, transactionID, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 20 || binary.BigEndian.Uint32(res[0:4]) != udpActionAnnounce {
+		return nil, fmt.Errorf("Received malformed udp announce response")
+	}
+
+	// trackers reached over ipv6 answer with 18 byte peers
+	if remote, ok := conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+		return unmarshal6(res[20:])
+	}
+	return unmarshal(res[20:])
+}
+
+// announces to a udp tracker as described in BEP 15, the connection id is
+// cached per tracker and requests are retransmitted with growing timeouts
+func (t *TorrentFile) requestUDPPeers(announce string, port uint16, event string, progress Progress) ([]Peer, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for n := 0; n <= udpMaxRetries; n++ {
+		connectionID, ok := cachedConnectionID(u.Host)
+		if !ok {
+			connectionID, err = udpConnect(conn, udpTimeout(n))
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			cacheConnectionID(u.Host, connectionID)
+		}
+
+		peers, err := t.udpAnnounce(conn, connectionID, port, event, progress, udpTimeout(n))
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		if err != nil {
+			// the tracker may have expired our connection id early
+			forgetConnectionID(u.Host)
+			return nil, err
+		}
+		return peers, nil
+	}
+
+	return nil, errUDPTimeout
+}
+
+// identifies us to udp trackers across announces
+var udpKey = func() uint32 {
+	key, err := newTransactionID()
+	if err != nil {
+		return 0
+	}
+	return key
+}()
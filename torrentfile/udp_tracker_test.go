@@ -0,0 +1,348 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an in process udp tracker speaking just enough BEP 15 for the client
+type fakeUDPTracker struct {
+	conn *net.UDPConn
+	peer Peer
+
+	mu        sync.Mutex
+	packets   int
+	connects  int
+	announces int
+	// packets to ignore before answering again, -1 ignores everything
+	drop int
+	// when set announces are answered with this error
+	failWith string
+	nextID   uint64
+	ids      map[uint64]bool
+	events   []uint32
+	// downloaded, left and uploaded of the last announce
+	progress [3]uint64
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &fakeUDPTracker{
+		conn:   conn,
+		peer:   Peer{IP: net.IPv4(10, 1, 2, 3), Port: 6881},
+		nextID: 1000,
+		ids:    make(map[uint64]bool),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go tr.serve()
+	return tr
+}
+
+func (tr *fakeUDPTracker) url() string {
+	return "udp://" + tr.conn.LocalAddr().String() + "/announce"
+}
+
+func (tr *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := tr.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if reply := tr.handle(buf[:n]); reply != nil {
+			tr.conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+func (tr *fakeUDPTracker) handle(req []byte) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.packets++
+	if tr.drop != 0 {
+		if tr.drop > 0 {
+			tr.drop--
+		}
+		return nil
+	}
+	if len(req) < 16 {
+		return nil
+	}
+	action := binary.BigEndian.Uint32(req[8:12])
+	transactionID := req[12:16]
+
+	switch {
+	case action == udpActionConnect && binary.BigEndian.Uint64(req[0:8]) == udpProtocolID:
+		tr.connects++
+		tr.nextID++
+		tr.ids[tr.nextID] = true
+		reply := make([]byte, 16)
+		binary.BigEndian.PutUint32(reply[0:4], udpActionConnect)
+		copy(reply[4:8], transactionID)
+		binary.BigEndian.PutUint64(reply[8:16], tr.nextID)
+		return reply
+	case action == udpActionAnnounce && len(req) >= 98:
+		tr.announces++
+		if !tr.ids[binary.BigEndian.Uint64(req[0:8])] {
+			return udpError(transactionID, "Connection ID missmatch")
+		}
+		if tr.failWith != "" {
+			return udpError(transactionID, tr.failWith)
+		}
+		tr.events = append(tr.events, binary.BigEndian.Uint32(req[80:84]))
+		for i := range tr.progress {
+			tr.progress[i] = binary.BigEndian.Uint64(req[56+8*i:])
+		}
+		reply := make([]byte, 20)
+		binary.BigEndian.PutUint32(reply[0:4], udpActionAnnounce)
+		copy(reply[4:8], transactionID)
+		binary.BigEndian.PutUint32(reply[8:12], 1800)
+		return append(reply, tr.peer.Compact()...)
+	}
+	return nil
+}
+
+func udpError(transactionID []byte, msg string) []byte {
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint32(reply[0:4], udpActionError)
+	copy(reply[4:8], transactionID)
+	return append(reply, msg...)
+}
+
+func (tr *fakeUDPTracker) counts() (packets, connects, announces int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.packets, tr.connects, tr.announces
+}
+
+func shortUDPTimeouts(t *testing.T) {
+	base := udpBaseTimeout
+	udpBaseTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { udpBaseTimeout = base })
+}
+
+func testTorrentFile(trackers ...[]string) *TorrentFile {
+	return &TorrentFile{InfoHash: [20]byte{1, 2, 3}, PeerID: [20]byte{4, 5, 6}, AnnounceList: trackers}
+}
+
+func TestUDPAnnounceReusesConnectionID(t *testing.T) {
+	tr := newFakeUDPTracker(t)
+	tf := testTorrentFile([]string{tr.url()})
+
+	progress := Progress{Downloaded: 300, Uploaded: 200, Left: 100}
+	for _, event := range []string{"started", "", "stopped"} {
+		peers, err := tf.requestUDPPeers(tr.url(), 6881, event, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0].String() != tr.peer.String() {
+			t.Fatalf("got peers %v", peers)
+		}
+	}
+
+	_, connects, announces := tr.counts()
+	if connects != 1 || announces != 3 {
+		t.Errorf("%d connects and %d announces, want the connection id reused", connects, announces)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if got := tr.events; len(got) != 3 || got[0] != 2 || got[1] != 0 || got[2] != 3 {
+		t.Errorf("events %v, want started, none and stopped", got)
+	}
+	if tr.progress != [3]uint64{300, 100, 200} {
+		t.Errorf("announced downloaded, left and uploaded as %v", tr.progress)
+	}
+}
+
+func TestUDPConnectionIDExpires(t *testing.T) {
+	tr := newFakeUDPTracker(t)
+	tf := testTorrentFile([]string{tr.url()})
+
+	_, err := tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := tr.conn.LocalAddr().String()
+	udpConnectionIDs.Lock()
+	c := udpConnectionIDs.ids[host]
+	c.received = time.Now().Add(-udpConnectionIDLifetime - time.Second)
+	udpConnectionIDs.ids[host] = c
+	udpConnectionIDs.Unlock()
+
+	_, err = tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, connects, _ := tr.counts(); connects != 2 {
+		t.Errorf("%d connects, want a new connection id after expiry", connects)
+	}
+}
+
+func TestUDPRetransmits(t *testing.T) {
+	shortUDPTimeouts(t)
+	tr := newFakeUDPTracker(t)
+	tf := testTorrentFile([]string{tr.url()})
+
+	// lose the first connect, then the first announce made with the cached id
+	tr.mu.Lock()
+	tr.drop = 1
+	tr.mu.Unlock()
+	_, err := tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.mu.Lock()
+	tr.drop = 1
+	tr.mu.Unlock()
+	_, err = tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets, connects, announces := tr.counts()
+	if packets != 5 || connects != 1 || announces != 2 {
+		t.Errorf("%d packets, %d connects, %d announces", packets, connects, announces)
+	}
+}
+
+func TestUDPGivesUp(t *testing.T) {
+	shortUDPTimeouts(t)
+	tr := newFakeUDPTracker(t)
+	tr.mu.Lock()
+	tr.drop = -1
+	tr.mu.Unlock()
+	tf := testTorrentFile([]string{tr.url()})
+
+	start := time.Now()
+	_, err := tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	// 50 and 100ms for the connect sent twice
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("gave up after %v without backing off", elapsed)
+	}
+	if packets, _, _ := tr.counts(); packets != udpMaxRetries+1 {
+		t.Errorf("sent %d packets, want %d", packets, udpMaxRetries+1)
+	}
+}
+
+func TestUDPErrorAction(t *testing.T) {
+	tr := newFakeUDPTracker(t)
+	tf := testTorrentFile([]string{tr.url()})
+
+	_, err := tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	tr.failWith = "torrent not registered"
+	tr.mu.Unlock()
+	_, err = tf.requestUDPPeers(tr.url(), 6881, "", Progress{})
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("got %v, want the tracker's error", err)
+	}
+	if _, ok := cachedConnectionID(tr.conn.LocalAddr().String()); ok {
+		t.Error("connection id kept after the tracker returned an error")
+	}
+}
+
+func TestRequestPeersSkipsDeadTrackers(t *testing.T) {
+	shortUDPTimeouts(t)
+	// bound but never answering, like a tracker that went away
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	deadURL := "udp://" + dead.LocalAddr().String() + "/announce"
+	tr := newFakeUDPTracker(t)
+
+	tf := testTorrentFile([]string{deadURL, tr.url()})
+	start := time.Now()
+	peers, err := tf.RequestPeers(6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Errorf("got peers %v", peers)
+	}
+	if tf.AnnounceList[0][0] != tr.url() {
+		t.Error("the tracker that answered was not promoted")
+	}
+	// the dead tracker was given up on after its retransmission
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the dead tracker held the announce up for %v", elapsed)
+	}
+
+	// and is not waited for again while the promoted one answers
+	start = time.Now()
+	_, err = tf.RequestPeers(6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("the dead tracker was tried before the promoted one, took %v", elapsed)
+	}
+}
+
+func TestRequestPeersAnnouncesStarted(t *testing.T) {
+	tr := newFakeUDPTracker(t)
+	tf := testTorrentFile([]string{tr.url()})
+	tf.Length = 5000
+	tf.InfoBytes = []byte("d4:name1:xe")
+
+	_, err := tf.RequestPeers(6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.events) != 1 || tr.events[0] != udpEvents["started"] {
+		t.Errorf("events %v, want started", tr.events)
+	}
+	if tr.progress != [3]uint64{0, 5000, 0} {
+		t.Errorf("announced downloaded, left and uploaded as %v", tr.progress)
+	}
+}
+
+func TestRequestPeersTrackerTimeout(t *testing.T) {
+	timeout := trackerTimeout
+	trackerTimeout = 200 * time.Millisecond
+	defer func() { trackerTimeout = timeout }()
+
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	deadURL := "udp://" + dead.LocalAddr().String() + "/announce"
+	tr := newFakeUDPTracker(t)
+
+	tf := testTorrentFile([]string{deadURL}, []string{deadURL}, []string{tr.url()})
+	start := time.Now()
+	peers, err := tf.RequestPeers(6881)
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("got %v, %v", peers, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dead trackers held the announce up for %v", elapsed)
+	}
+
+	_, err = testTorrentFile([]string{deadURL}).RequestPeers(6881)
+	if err == nil {
+		t.Error("no error when no tracker answered")
+	}
+}
@@ -0,0 +1,663 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payload bytes per packet, keeps packets with a selective ack under
+	// common path MTUs
+	maxPayload = 1350
+	// bytes we buffer for the reader before the peer has to stop sending
+	recvWindow = 1 << 20
+	// how far ahead of the next expected packet we keep packets that arrived
+	// out of order
+	maxReorder = 1024
+
+	// LEDBAT aims to add at most this much queuing delay (in microseconds)
+	targetDelay = 100000
+	// the congestion window grows by at most this much per round trip
+	maxWindowIncrease = 3000
+	minWindow         = maxPayload
+	initialWindow     = 3 * maxPayload
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// consecutive timeouts before the peer is given up on
+	maxTimeouts = 8
+	// a packet selectively acked past this many times is resent right away
+	duplicateAcks = 3
+
+	tickInterval = 50 * time.Millisecond
+	// how long a closed connection waits for its data and FIN to be acked
+	closeLinger = 30 * time.Second
+)
+
+var (
+	errReset   = errors.New("uTP connection reset by peer")
+	errTimeout = errors.New("uTP connection timed out")
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// Conn is a uTP connection, it is a reliable ordered byte stream like TCP
+// that backs off as soon as it starts adding delay to the link
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	state connState
+	// closed once the peer acked our SYN
+	connected chan struct{}
+	// closed once the connection is gone
+	done chan struct{}
+	err  error
+
+	// signalled when there is something to read or room to send
+	readable chan struct{}
+	writable chan struct{}
+
+	// the next sequence number we send and the last one received in order
+	seqNr uint16
+	ackNr uint16
+	// echoed to the peer as the delay of its packets
+	replyMicro uint32
+
+	inflight    []*outgoing
+	flightBytes int
+	window      float64
+	peerWindow  int
+	delays      delayHistory
+	rtt         time.Duration
+	rttVar      time.Duration
+	rto         time.Duration
+	timeouts    int
+
+	readBuf      []byte
+	reorder      map[uint16]*packet
+	reorderBytes int
+	// the window advertised last, an update is sent when reading opens it up
+	advertised int
+	eof        bool
+
+	closing  bool
+	closedAt time.Time
+
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+}
+
+// a packet sent but not acked yet
+type outgoing struct {
+	p             *packet
+	size          int
+	sentAt        time.Time
+	transmissions int
+	// later packets selectively acked while this one wasn't
+	skipped int
+}
+
+// keeps the lowest delay seen in each of the last two minutes, the lowest of
+// them is taken as the delay of an empty link
+type delayHistory struct {
+	current, previous uint32
+	hasPrevious       bool
+	started           time.Time
+}
+
+func (d *delayHistory) add(sample uint32, now time.Time) {
+	if d.started.IsZero() || now.Sub(d.started) > time.Minute {
+		d.previous, d.hasPrevious = d.current, !d.started.IsZero()
+		d.current = sample
+		d.started = now
+		return
+	}
+	d.current = min(d.current, sample)
+}
+
+func (d *delayHistory) base() uint32 {
+	if d.hasPrevious {
+		return min(d.current, d.previous)
+	}
+	return d.current
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:               s,
+		raddr:           raddr,
+		recvID:          recvID,
+		sendID:          sendID,
+		connected:       make(chan struct{}),
+		done:            make(chan struct{}),
+		readable:        make(chan struct{}, 1),
+		writable:        make(chan struct{}, 1),
+		window:          initialWindow,
+		peerWindow:      recvWindow,
+		rto:             initialTimeout,
+		reorder:         make(map[uint16]*packet),
+		advertised:      recvWindow,
+		deadlineChanged: make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// sends our SYN, the connection is up once the peer acks it
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqNr = 1
+	c.sendPacket(stSyn, nil)
+}
+
+// sets up the state of a connection the peer opened with syn
+func (c *Conn) acceptSyn(syn *packet) error {
+	seq, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqNr = seq
+	c.ackNr = syn.seqNr
+	c.replyMicro = micros(time.Now()) - syn.timestamp
+	c.peerWindow = int(syn.wndSize)
+	c.state = stateConnected
+	close(c.connected)
+	return nil
+}
+
+func (c *Conn) ackSyn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendState()
+}
+
+// stamps p with the current ack state and sends it
+func (c *Conn) send(p *packet) {
+	now := time.Now()
+	p.connID = c.sendID
+	if p.typ == stSyn {
+		p.connID = c.recvID
+	}
+	p.timestamp = micros(now)
+	p.timestampDiff = c.replyMicro
+	p.wndSize = uint32(c.receiveWindow())
+	p.ackNr = c.ackNr
+	p.sack = c.selectiveAck()
+	c.advertised = int(p.wndSize)
+	c.s.pc.WriteToUDP(p.marshal(), c.raddr)
+}
+
+// sends a packet that takes a sequence number and has to be acked
+func (c *Conn) sendPacket(typ byte, payload []byte) {
+	p := &packet{header: header{typ: typ, seqNr: c.seqNr}, payload: payload}
+	c.seqNr++
+	c.inflight = append(c.inflight, &outgoing{p: p, size: len(payload), sentAt: time.Now(), transmissions: 1})
+	c.flightBytes += len(payload)
+	c.send(p)
+}
+
+func (c *Conn) sendState() {
+	c.send(&packet{header: header{typ: stState, seqNr: c.seqNr}})
+}
+
+func (c *Conn) resend(o *outgoing) {
+	o.sentAt = time.Now()
+	o.transmissions++
+	o.skipped = 0
+	c.send(o.p)
+}
+
+func (c *Conn) receiveWindow() int {
+	return max(0, recvWindow-len(c.readBuf)-c.reorderBytes)
+}
+
+// bit i is set when packet ackNr+2+i arrived, ackNr+1 is missing or it would
+// have been delivered
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	var highest uint16
+	for seq := range c.reorder {
+		highest = max(highest, seq-c.ackNr-2)
+	}
+	// the mask is a multiple of 4 bytes and has to fit the extension length
+	size := min((int(highest)/32+1)*4, 252)
+	mask := make([]byte, size)
+	for seq := range c.reorder {
+		bit := int(seq - c.ackNr - 2)
+		if bit < size*8 {
+			mask[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return mask
+}
+
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+
+	now := time.Now()
+	c.replyMicro = micros(now) - p.timestamp
+	c.peerWindow = int(p.wndSize)
+
+	switch p.typ {
+	case stReset:
+		c.teardown(errReset)
+		return
+	case stSyn:
+		// our ack of the SYN was lost
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if p.typ != stState {
+			return
+		}
+		// the peer's first data packet will carry the seq of this ack
+		c.ackNr = p.seqNr - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.processAck(p, now)
+	if p.typ == stData || p.typ == stFin {
+		c.receive(p)
+	}
+	c.maybeFinish(now)
+}
+
+// removes the packets p acks from flight and adjusts the window
+func (c *Conn) processAck(p *packet, now time.Time) {
+	acked := 0
+	ackOne := func(o *outgoing) {
+		acked += o.size
+		c.flightBytes -= o.size
+		if o.transmissions == 1 {
+			c.updateRTT(now.Sub(o.sentAt))
+		}
+	}
+
+	for len(c.inflight) > 0 && !seqLess(p.ackNr, c.inflight[0].p.seqNr) {
+		ackOne(c.inflight[0])
+		c.inflight = c.inflight[1:]
+	}
+
+	if len(p.sack) > 0 {
+		sacked := func(seq uint16) bool {
+			bit := int(seq - p.ackNr - 2)
+			return bit >= 0 && bit < len(p.sack)*8 && p.sack[bit/8]&(1<<(bit%8)) != 0
+		}
+		remaining := c.inflight[:0]
+		for _, o := range c.inflight {
+			if sacked(o.p.seqNr) {
+				ackOne(o)
+				continue
+			}
+			remaining = append(remaining, o)
+		}
+		c.inflight = remaining
+
+		// a packet is taken as lost once enough packets sent after it arrived
+		lost := false
+		for _, o := range c.inflight {
+			skipped := 0
+			for bit := 0; bit < len(p.sack)*8; bit++ {
+				seq := p.ackNr + 2 + uint16(bit)
+				if seqLess(o.p.seqNr, seq) && p.sack[bit/8]&(1<<(bit%8)) != 0 {
+					skipped++
+				}
+			}
+			if skipped >= duplicateAcks && o.skipped < duplicateAcks {
+				c.resend(o)
+				lost = true
+			}
+			o.skipped = skipped
+		}
+		if lost {
+			c.window = max(c.window/2, minWindow)
+		}
+	}
+
+	if acked > 0 {
+		c.timeouts = 0
+		c.ledbat(acked, p.timestampDiff, now)
+		notify(c.writable)
+	}
+}
+
+// grows the window while the delay our packets see is under the target and
+// shrinks it once they start queuing behind each other
+func (c *Conn) ledbat(acked int, delay uint32, now time.Time) {
+	if delay == 0 {
+		// the peer had nothing to measure yet
+		return
+	}
+	c.delays.add(delay, now)
+	ourDelay := float64(delay - c.delays.base())
+	offTarget := (targetDelay - ourDelay) / targetDelay
+	c.window += maxWindowIncrease * offTarget * float64(acked) / c.window
+	c.window = max(c.window, minWindow)
+	c.window = min(c.window, float64(max(c.peerWindow, minWindow)))
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minTimeout), maxTimeout)
+}
+
+// delivers p in order, keeping it aside when packets before it are missing
+func (c *Conn) receive(p *packet) {
+	if !seqLess(c.ackNr, p.seqNr) {
+		// already delivered, our ack must have been lost
+		c.sendState()
+		return
+	}
+
+	if p.seqNr != c.ackNr+1 {
+		if p.seqNr-c.ackNr <= maxReorder && c.reorder[p.seqNr] == nil {
+			c.reorder[p.seqNr] = p
+			c.reorderBytes += len(p.payload)
+		}
+		c.sendState()
+		return
+	}
+
+	c.deliver(p)
+	for next := c.reorder[c.ackNr+1]; next != nil; next = c.reorder[c.ackNr+1] {
+		delete(c.reorder, next.seqNr)
+		c.reorderBytes -= len(next.payload)
+		c.deliver(next)
+	}
+	c.sendState()
+	notify(c.readable)
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.ackNr = p.seqNr
+	if c.eof {
+		return
+	}
+	if p.typ == stFin {
+		c.eof = true
+		return
+	}
+	c.readBuf = append(c.readBuf, p.payload...)
+}
+
+// a connection we closed is done once everything we sent was acked
+func (c *Conn) maybeFinish(now time.Time) {
+	if !c.closing || c.state == stateClosed {
+		return
+	}
+	if len(c.inflight) == 0 {
+		c.teardown(net.ErrClosed)
+	} else if now.Sub(c.closedAt) > closeLinger {
+		c.teardown(errTimeout)
+	}
+}
+
+// ends the connection, err is what blocked reads and writes return
+func (c *Conn) teardown(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	close(c.done)
+	notify(c.readable)
+	notify(c.writable)
+	c.s.remove(c)
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.teardown(err)
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// resends packets that weren't acked in time
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.tick(now)
+		}
+	}
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed || len(c.inflight) == 0 {
+		c.maybeFinish(now)
+		return
+	}
+	if now.Sub(c.inflight[0].sentAt) < c.rto {
+		return
+	}
+
+	c.timeouts++
+	if c.timeouts > maxTimeouts {
+		c.teardown(errTimeout)
+		return
+	}
+	c.window = minWindow
+	for _, o := range c.inflight {
+		if now.Sub(o.sentAt) >= c.rto {
+			c.resend(o)
+		}
+	}
+	c.rto = min(c.rto*2, maxTimeout)
+	c.maybeFinish(now)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// blocks until ch is signalled, the connection ends or the deadline passes
+func (c *Conn) wait(ch chan struct{}, deadline time.Time, changed chan struct{}) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-changed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// tell a peer that stopped on our window it can go on
+			if c.state == stateConnected && c.advertised < recvWindow/2 && c.receiveWindow() >= recvWindow/2 {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		err := c.wait(c.readable, deadline, changed)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.state == stateClosed {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			c.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		size := min(maxPayload, len(b)-written)
+		window := min(int(c.window), c.peerWindow)
+		if c.flightBytes > 0 && c.flightBytes+size > window {
+			deadline, changed := c.writeDeadline, c.deadlineChanged
+			c.mu.Unlock()
+			err := c.wait(c.writable, deadline, changed)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		payload := make([]byte, size)
+		copy(payload, b[written:])
+		c.sendPacket(stData, payload)
+		c.mu.Unlock()
+		written += size
+	}
+	return written, nil
+}
+
+// sends a FIN after the data written so far, the connection is kept until
+// it has all been acked
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing || c.state == stateClosed {
+		return nil
+	}
+	c.closing = true
+	c.closedAt = time.Now()
+	notify(c.readable)
+	notify(c.writable)
+	if c.state != stateConnected {
+		c.teardown(net.ErrClosed)
+		return nil
+	}
+	c.sendPacket(stFin, nil)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.deadlineUpdated()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.deadlineUpdated()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.deadlineUpdated()
+	return nil
+}
+
+// wakes blocked reads and writes to pick up a new deadline
+func (c *Conn) deadlineUpdated() {
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+}
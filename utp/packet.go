@@ -0,0 +1,111 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// packet types (BEP 29)
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extNone         = 0
+	extSelectiveAck = 1
+)
+
+type header struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	// the sender's view of the one way delay of our packets
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// bit i marks packet ackNr+2+i as received, empty when nothing arrived
+	// out of order
+	sack []byte
+}
+
+type packet struct {
+	header
+	payload []byte
+}
+
+// true when b starts like a uTP packet, anything else on the socket belongs
+// to another protocol such as the DHT
+func isPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func (p *packet) marshal() []byte {
+	size := headerSize + len(p.payload)
+	if len(p.sack) > 0 {
+		size += 2 + len(p.sack)
+	}
+	b := make([]byte, headerSize, size)
+	b[0] = p.typ<<4 | version
+	b[1] = extNone
+	if len(p.sack) > 0 {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:4], p.connID)
+	binary.BigEndian.PutUint32(b[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(b[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(b[18:20], p.ackNr)
+	if len(p.sack) > 0 {
+		b = append(b, extNone, byte(len(p.sack)))
+		b = append(b, p.sack...)
+	}
+	return append(b, p.payload...)
+}
+
+func unmarshal(b []byte) (*packet, error) {
+	if !isPacket(b) {
+		return nil, fmt.Errorf("Not a uTP packet")
+	}
+
+	p := &packet{header: header{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wndSize:       binary.BigEndian.Uint32(b[12:16]),
+		seqNr:         binary.BigEndian.Uint16(b[16:18]),
+		ackNr:         binary.BigEndian.Uint16(b[18:20]),
+	}}
+
+	// extensions are chained, each names the type of the one after it
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != extNone {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("uTP extension overruns the packet")
+		}
+		next, data := rest[0], rest[2:2+int(rest[1])]
+		if ext == extSelectiveAck {
+			p.sack = data
+		}
+		ext = next
+		rest = rest[2+len(data):]
+	}
+	p.payload = rest
+	return p, nil
+}
+
+// sequence numbers wrap around, a is before b when it is less than half the
+// number space behind it
+func seqLess(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
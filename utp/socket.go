@@ -0,0 +1,327 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// incoming connections waiting for Accept, more are reset
+	acceptBacklog = 32
+	// packets of other protocols waiting for ReadFrom, more are dropped
+	packetBacklog = 256
+)
+
+// Socket carries uTP connections (BEP 29) over one UDP socket. It is a
+// net.Listener for incoming uTP connections and a net.PacketConn for every
+// other packet arriving on the port, so the DHT can share it
+type Socket struct {
+	pc *net.UDPConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	accepts chan *Conn
+	packets chan rawPacket
+
+	deadlineMu      sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// connections are told apart by the peer's address and the id the peer puts
+// in the packets it sends us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type rawPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+func Listen(port uint16) (*Socket, error) {
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Socket{
+		pc:              pc,
+		conns:           make(map[connKey]*Conn),
+		accepts:         make(chan *Conn, acceptBacklog),
+		packets:         make(chan rawPacket, packetBacklog),
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// the UDP port the socket is bound to
+func (s *Socket) Port() uint16 {
+	return uint16(s.pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		if !isPacket(buf[:n]) {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			select {
+			case s.packets <- rawPacket{data: data, addr: addr}:
+			default:
+			}
+			continue
+		}
+
+		p, err := unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		// the payload is kept by the connection past the next read
+		p.payload = append([]byte(nil), p.payload...)
+		p.sack = append([]byte(nil), p.sack...)
+		s.dispatch(p, addr)
+	}
+}
+
+// hands a packet to its connection, a SYN for an unknown connection starts
+// a new one
+func (s *Socket) dispatch(p *packet, addr *net.UDPAddr) {
+	s.mu.Lock()
+	c := s.conns[connKey{addr: addr.String(), id: p.connID}]
+	if c == nil && p.typ == stSyn {
+		// we answer the SYN's id plus one, a repeated SYN finds it there
+		c = s.conns[connKey{addr: addr.String(), id: p.connID + 1}]
+	}
+	if c == nil && p.typ == stReset {
+		// resets echo the id of the packet they answer, which is our send id
+		// and one off from the id we receive on
+		c = s.conns[connKey{addr: addr.String(), id: p.connID + 1}]
+		if c == nil {
+			c = s.conns[connKey{addr: addr.String(), id: p.connID - 1}]
+		}
+	}
+	s.mu.Unlock()
+
+	if c == nil && p.typ == stSyn {
+		s.accept(p, addr)
+		return
+	}
+	if c == nil {
+		if p.typ != stReset {
+			s.sendReset(p, addr)
+		}
+		return
+	}
+	c.handle(p)
+}
+
+// starts an incoming connection and queues it for Accept
+func (s *Socket) accept(syn *packet, addr *net.UDPAddr) {
+	c := newConn(s, addr, syn.connID+1, syn.connID)
+	err := c.acceptSyn(syn)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	select {
+	case s.accepts <- c:
+		s.conns[connKey{addr: addr.String(), id: c.recvID}] = c
+	default:
+		c = nil
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		s.sendReset(syn, addr)
+		return
+	}
+	c.ackSyn()
+}
+
+func (s *Socket) sendReset(p *packet, addr *net.UDPAddr) {
+	reset := &packet{header: header{
+		typ:       stReset,
+		connID:    p.connID,
+		timestamp: micros(time.Now()),
+		ackNr:     p.seqNr,
+	}}
+	s.pc.WriteToUDP(reset.marshal(), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{addr: c.raddr.String(), id: c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// opens a uTP connection, failing when the peer hasn't answered our SYN
+// within timeout
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var c *Conn
+	for c == nil {
+		id, err := randomID()
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if s.conns[connKey{addr: raddr.String(), id: id}] == nil {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[connKey{addr: raddr.String(), id: id}] = c
+		}
+	}
+	s.mu.Unlock()
+
+	c.connect()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.closeErr()
+	case <-timer.C:
+		c.fail(fmt.Errorf("uTP connection to %s timed out", addr))
+		return nil, c.closeErr()
+	}
+}
+
+// waits for the next incoming uTP connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepts:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// closes the socket along with every uTP connection on it
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// reads the next packet that isn't uTP
+func (s *Socket) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		s.deadlineMu.Lock()
+		deadline, changed := s.readDeadline, s.deadlineChanged
+		s.deadlineMu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-s.packets:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.data), p.addr, nil
+		case <-s.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.pc.WriteTo(b, addr)
+}
+
+func (s *Socket) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *Socket) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *Socket) SetReadDeadline(t time.Time) error {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+	s.readDeadline = t
+	close(s.deadlineChanged)
+	s.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// writes go straight to the UDP socket and never wait long enough to need a
+// deadline
+func (s *Socket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func randomID() (uint16, error) {
+	b := make([]byte, 2)
+	_, err := rand.Read(b)
+	return binary.BigEndian.Uint16(b), err
+}
+
+func micros(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
@@ -0,0 +1,359 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a packet seen by the relay
+type relayed struct {
+	p *packet
+	// sent by the dialing side towards the listener
+	forward bool
+	at      time.Time
+}
+
+// sits between a dialing socket and a listening one, the filter decides
+// whether each packet is dropped and how long it is held back
+type relay struct {
+	pc     *net.UDPConn
+	target *net.UDPAddr
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	filter func(p *packet, forward bool) (drop bool, delay time.Duration)
+	log    []relayed
+}
+
+func newRelay(t *testing.T, target *Socket) *relay {
+	t.Helper()
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{pc: pc, target: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(target.Port())}}
+	t.Cleanup(func() { pc.Close() })
+	go r.run()
+	return r
+}
+
+func (r *relay) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := r.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		p, err := unmarshal(data)
+		if err != nil {
+			continue
+		}
+
+		r.mu.Lock()
+		forward := addr.Port != r.target.Port
+		dst := r.target
+		if forward {
+			r.client = addr
+		} else {
+			dst = r.client
+		}
+		r.log = append(r.log, relayed{p: p, forward: forward, at: time.Now()})
+		var drop bool
+		var delay time.Duration
+		if r.filter != nil {
+			drop, delay = r.filter(p, forward)
+		}
+		r.mu.Unlock()
+
+		if drop || dst == nil {
+			continue
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() { r.pc.WriteToUDP(data, dst) })
+			continue
+		}
+		r.pc.WriteToUDP(data, dst)
+	}
+}
+
+func (r *relay) setFilter(filter func(p *packet, forward bool) (bool, time.Duration)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filter = filter
+}
+
+func (r *relay) packets() []relayed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]relayed{}, r.log...)
+}
+
+// when each transmission of the dialer's packet with this seq passed the relay
+func (r *relay) transmissions(seq uint16) []time.Time {
+	var times []time.Time
+	for _, rp := range r.packets() {
+		if rp.forward && rp.p.typ == stData && rp.p.seqNr == seq {
+			times = append(times, rp.at)
+		}
+	}
+	return times
+}
+
+// a dialed connection through a relay and the connection it was accepted as
+func relayedPair(t *testing.T) (*Conn, *Conn, *relay) {
+	t.Helper()
+	dialer, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialer.Close() })
+	listener, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	r := newRelay(t, listener)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := listener.Accept()
+		accepted <- c
+	}()
+	c, err := dialer.DialTimeout(r.pc.LocalAddr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case a := <-accepted:
+		return c.(*Conn), a.(*Conn), r
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was never accepted")
+	}
+	return nil, nil, nil
+}
+
+// writes size random bytes on one side and checks they come out of the other
+func send(t *testing.T, from, to *Conn, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+
+	go func() {
+		from.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		from.Write(data)
+	}()
+
+	to.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, size)
+	_, err := io.ReadFull(to, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream was corrupted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c, a, r := relayedPair(t)
+
+	if c.sendID != a.recvID || c.recvID != a.sendID {
+		t.Errorf("connection ids don't pair up: %d/%d and %d/%d", c.recvID, c.sendID, a.recvID, a.sendID)
+	}
+	log := r.packets()
+	if len(log) < 2 || log[0].p.typ != stSyn || log[1].p.typ != stState || log[1].p.ackNr != log[0].p.seqNr {
+		t.Fatalf("handshake was not a SYN acked by a STATE")
+	}
+	send(t, c, a, 10000)
+	send(t, a, c, 10000)
+}
+
+func TestHandshakeRetransmitsSyn(t *testing.T) {
+	dialer, _ := Listen(0)
+	defer dialer.Close()
+	listener, _ := Listen(0)
+	defer listener.Close()
+	r := newRelay(t, listener)
+
+	synsSeen := 0
+	r.setFilter(func(p *packet, forward bool) (bool, time.Duration) {
+		if p.typ == stSyn {
+			synsSeen++
+			return synsSeen == 1, 0
+		}
+		return false, 0
+	})
+	start := time.Now()
+	_, err := dialer.DialTimeout(r.pc.LocalAddr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < initialTimeout {
+		t.Errorf("connected after %v although the first SYN was lost", elapsed)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	dialer, _ := Listen(0)
+	defer dialer.Close()
+	silent, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer silent.Close()
+
+	_, err := dialer.DialTimeout(silent.LocalAddr().String(), 300*time.Millisecond)
+	if err == nil {
+		t.Fatal("dial to a silent address succeeded")
+	}
+}
+
+func TestReordering(t *testing.T) {
+	c, a, r := relayedPair(t)
+
+	// the second data packet arrives after the ones following it
+	r.setFilter(func(p *packet, forward bool) (bool, time.Duration) {
+		if forward && p.typ == stData && p.seqNr == 3 && len(r.transmissionsLocked(3)) == 1 {
+			return false, 30 * time.Millisecond
+		}
+		return false, 0
+	})
+	send(t, c, a, 20*maxPayload)
+
+	sacked := false
+	for _, rp := range r.packets() {
+		if !rp.forward && rp.p.typ == stState && len(rp.p.sack) > 0 && rp.p.ackNr == 2 {
+			sacked = true
+		}
+	}
+	if !sacked {
+		t.Error("receiver never selectively acked the packets after the late one")
+	}
+}
+
+// like transmissions for use inside a filter, which runs with r.mu held
+func (r *relay) transmissionsLocked(seq uint16) []time.Time {
+	var times []time.Time
+	for _, rp := range r.log {
+		if rp.forward && rp.p.typ == stData && rp.p.seqNr == seq {
+			times = append(times, rp.at)
+		}
+	}
+	return times
+}
+
+func TestFastRetransmit(t *testing.T) {
+	c, a, r := relayedPair(t)
+
+	// grow the window first so enough packets follow the lost one
+	send(t, c, a, 200*maxPayload)
+	c.mu.Lock()
+	lost := c.seqNr + 10
+	c.mu.Unlock()
+	r.setFilter(func(p *packet, forward bool) (bool, time.Duration) {
+		return forward && p.typ == stData && p.seqNr == lost && len(r.transmissionsLocked(lost)) == 1, 0
+	})
+	send(t, c, a, 100*maxPayload)
+
+	sent := r.transmissions(lost)
+	if len(sent) != 2 {
+		t.Fatalf("lost packet was sent %d times", len(sent))
+	}
+	// well before the retransmission timeout, which is at least minTimeout
+	if gap := sent[1].Sub(sent[0]); gap >= minTimeout {
+		t.Errorf("resent after %v, the selective acks didn't trigger it", gap)
+	}
+}
+
+func TestTimeoutRetransmit(t *testing.T) {
+	c, a, r := relayedPair(t)
+
+	// a single packet has nothing after it to be selectively acked by
+	c.mu.Lock()
+	lost := c.seqNr
+	c.mu.Unlock()
+	r.setFilter(func(p *packet, forward bool) (bool, time.Duration) {
+		return forward && p.typ == stData && p.seqNr == lost && len(r.transmissionsLocked(lost)) == 1, 0
+	})
+	send(t, c, a, 100)
+
+	sent := r.transmissions(lost)
+	if len(sent) != 2 {
+		t.Fatalf("lost packet was sent %d times", len(sent))
+	}
+	if gap := sent[1].Sub(sent[0]); gap < minTimeout-tickInterval {
+		t.Errorf("resent after %v, before the retransmission timeout", gap)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, a, r := relayedPair(t)
+
+	data := make([]byte, 50*maxPayload)
+	rand.Read(data)
+	_, err := c.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// everything written before the FIN arrives, then EOF
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(a)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closed connection lingered after its FIN was acked")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("read from a closed connection succeeded")
+	}
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("write to a closed connection succeeded")
+	}
+
+	fins := 0
+	for _, rp := range r.packets() {
+		if rp.forward && rp.p.typ == stFin {
+			fins++
+		}
+	}
+	if fins != 1 {
+		t.Errorf("sent %d FINs", fins)
+	}
+
+	// its FIN finds the connection gone and is answered with a reset
+	a.Close()
+	select {
+	case <-a.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other side never finished closing")
+	}
+}
+
+func TestSocketCloseResetsReads(t *testing.T) {
+	c, a, _ := relayedPair(t)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := a.Read(make([]byte, 1))
+		read <- err
+	}()
+	c.s.Close()
+	a.s.Close()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("read returned no error after the socket closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read blocked after the socket closed")
+	}
+}